@@ -2,7 +2,10 @@ module github.com/mehmetdenizer/gosmtpmail
 
 go 1.22.3
 
-require github.com/mehmetdenizer/gohelpers v1.0.0
+require (
+	github.com/mehmetdenizer/gohelpers v1.0.0
+	golang.org/x/text v0.16.0
+)
 
 require (
 	github.com/sirupsen/logrus v1.9.3 // indirect
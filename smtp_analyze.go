@@ -0,0 +1,112 @@
+package gosmtpmail
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+)
+
+// Deliverability thresholds used by AnalyzeMessage
+const (
+	analyzeMaxMessageSize = 10 << 20
+	analyzeMaxHeaderCount = 50
+)
+
+// MessageIssue is a deliverability issue found by AnalyzeMessage
+type MessageIssue struct {
+	Code    string
+	Message string
+	Penalty int
+}
+
+// MessageReport is the result of AnalyzeMessage. Score starts at 100 and is
+// reduced by the penalty of each issue, down to 0.
+type MessageReport struct {
+	Score  int
+	Issues []MessageIssue
+}
+
+// addIssue records an issue and lowers the score
+func (r *MessageReport) addIssue(code, message string, penalty int) {
+	r.Issues = append(r.Issues, MessageIssue{Code: code, Message: message, Penalty: penalty})
+	r.Score -= penalty
+	if r.Score < 0 {
+		r.Score = 0
+	}
+}
+
+// AnalyzeMessage inspects a composed message for structural issues that are
+// likely to hurt deliverability. It doesn't use the network.
+func AnalyzeMessage(message []byte) MessageReport {
+	report := MessageReport{Score: 100}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		report.addIssue("unparseable", "message can't be parsed: "+err.Error(), 100)
+		return report
+	}
+
+	// Headers
+	if msg.Header.Get("Date") == "" {
+		report.addIssue("missing-date", "Date header is missing", 10)
+	}
+	if msg.Header.Get("Message-ID") == "" {
+		report.addIssue("missing-message-id", "Message-ID header is missing", 10)
+	}
+	if msg.Header.Get("Subject") == "" {
+		report.addIssue("missing-subject", "Subject header is missing or empty", 5)
+	}
+	headerCount := 0
+	for _, values := range msg.Header {
+		headerCount += len(values)
+	}
+	if headerCount > analyzeMaxHeaderCount {
+		report.addIssue("too-many-headers", "message has an unusually large number of headers", 10)
+	}
+	precedence := strings.ToLower(msg.Header.Get("Precedence"))
+	isBulk := precedence == "bulk" || precedence == "list" || msg.Header.Get("List-ID") != ""
+	if isBulk && msg.Header.Get("List-Unsubscribe") == "" {
+		report.addIssue("missing-list-unsubscribe", "bulk message has no List-Unsubscribe header", 20)
+	}
+
+	// Size
+	if len(message) > analyzeMaxMessageSize {
+		report.addIssue("oversized", "message is larger than 10 MB", 15)
+	}
+
+	// Body structure
+	contentTypes := make(map[string]bool)
+	collectContentTypes(msg.Header.Get("Content-Type"), msg.Body, contentTypes)
+	if contentTypes["text/html"] && !contentTypes["text/plain"] {
+		report.addIssue("html-only", "HTML body has no plain-text alternative", 15)
+	}
+
+	return report
+}
+
+// collectContentTypes records the media types of a body and its nested parts
+func collectContentTypes(contentType string, body io.Reader, contentTypes map[string]bool) {
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return
+	}
+	contentTypes[mediaType] = true
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return
+	}
+
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := reader.NextRawPart()
+		if err != nil {
+			return
+		}
+		collectContentTypes(part.Header.Get("Content-Type"), part, contentTypes)
+	}
+}
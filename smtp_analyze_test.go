@@ -0,0 +1,72 @@
+package gosmtpmail
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// analyzeHeaders are the headers of a message AnalyzeMessage has no issues with
+const analyzeHeaders = "From: <sender@example.com>\r\n" +
+	"To: <jane@example.com>\r\n" +
+	"Date: Wed, 04 Mar 2026 15:30:00 +0300\r\n" +
+	"Message-ID: <4f2a@example.com>\r\n" +
+	"Subject: Report\r\n"
+
+// alternativeBody is a multipart/alternative body with text and HTML parts
+const alternativeBody = "Content-Type: multipart/alternative; boundary=b\r\n\r\n" +
+	"--b\r\nContent-Type: text/plain\r\n\r\ntext\r\n" +
+	"--b\r\nContent-Type: text/html\r\n\r\n<p>html</p>\r\n" +
+	"--b--\r\n"
+
+func TestAnalyzeMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    []string
+	}{
+		{"clean", analyzeHeaders + alternativeBody, nil},
+		{"unparseable", "no headers", []string{"unparseable"}},
+		{"missing date", strings.Replace(analyzeHeaders, "Date: Wed, 04 Mar 2026 15:30:00 +0300\r\n", "", 1) + "\r\nbody", []string{"missing-date"}},
+		{"missing message id", strings.Replace(analyzeHeaders, "Message-ID: <4f2a@example.com>\r\n", "", 1) + "\r\nbody", []string{"missing-message-id"}},
+		{"empty subject", strings.Replace(analyzeHeaders, "Subject: Report", "Subject: ", 1) + "\r\nbody", []string{"missing-subject"}},
+		{"too many headers", analyzeHeaders + strings.Repeat("X-Tag: value\r\n", analyzeMaxHeaderCount) + "\r\nbody", []string{"too-many-headers"}},
+		{"bulk without unsubscribe", analyzeHeaders + "Precedence: bulk\r\n\r\nbody", []string{"missing-list-unsubscribe"}},
+		{"list without unsubscribe", analyzeHeaders + "List-ID: <news.example.com>\r\n\r\nbody", []string{"missing-list-unsubscribe"}},
+		{"bulk with unsubscribe", analyzeHeaders + "Precedence: bulk\r\nList-Unsubscribe: <mailto:u@example.com>\r\n\r\nbody", nil},
+		{"oversized", analyzeHeaders + "\r\n" + strings.Repeat("x", analyzeMaxMessageSize), []string{"oversized"}},
+		{"html only", analyzeHeaders + "Content-Type: text/html\r\n\r\n<p>html</p>", []string{"html-only"}},
+		{"nested html only", analyzeHeaders + "Content-Type: multipart/mixed; boundary=m\r\n\r\n" +
+			"--m\r\nContent-Type: text/html\r\n\r\n<p>html</p>\r\n--m--\r\n", []string{"html-only"}},
+	}
+	for _, tt := range tests {
+		report := AnalyzeMessage([]byte(tt.message))
+		var codes []string
+		penalty := 0
+		for _, issue := range report.Issues {
+			codes = append(codes, issue.Code)
+			penalty += issue.Penalty
+		}
+		if !slices.Equal(codes, tt.want) {
+			t.Errorf("%s: issues = %q, want %q", tt.name, codes, tt.want)
+		}
+		if want := max(100-penalty, 0); report.Score != want {
+			t.Errorf("%s: score = %d, want %d", tt.name, report.Score, want)
+		}
+	}
+}
+
+func TestAnalyzeComposedMessage(t *testing.T) {
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com"})
+	to := []string{"jane@example.com"}
+
+	report := AnalyzeMessage(composeMessage(t, "Report", "text", "<p>html</p>", "", to))
+	if report.Score != 100 || len(report.Issues) != 0 {
+		t.Errorf("composed message report = %+v, want no issues", report)
+	}
+
+	report = AnalyzeMessage(composeMessage(t, "Report", "", "<p>html</p>", "", to))
+	if len(report.Issues) != 1 || report.Issues[0].Code != "html-only" {
+		t.Errorf("HTML-only composed message issues = %+v, want html-only", report.Issues)
+	}
+}
@@ -0,0 +1,110 @@
+package gosmtpmail
+
+import (
+	"errors"
+	"fmt"
+	"net/smtp"
+	"strings"
+)
+
+// Authentication mechanisms accepted by EmailConfig.AuthMechanism
+const (
+	AuthPlain   = "PLAIN"
+	AuthLogin   = "LOGIN"
+	AuthCRAMMD5 = "CRAM-MD5"
+	// AuthAuto picks the strongest mechanism the server advertises
+	AuthAuto = "AUTO"
+)
+
+// autoAuthPreference is the order AuthAuto tries mechanisms in, strongest first
+var autoAuthPreference = []string{AuthCRAMMD5, AuthLogin, AuthPlain}
+
+// validAuthMechanism reports whether mechanism is supported ("" means PLAIN)
+func validAuthMechanism(mechanism string) bool {
+	switch strings.ToUpper(mechanism) {
+	case "", AuthPlain, AuthLogin, AuthCRAMMD5, AuthAuto:
+		return true
+	}
+	return false
+}
+
+// newAuth returns the smtp.Auth for mechanism
+func newAuth(mechanism, username, password, host string) smtp.Auth {
+	switch strings.ToUpper(mechanism) {
+	case AuthLogin:
+		return &loginAuth{username: username, password: password, host: host}
+	case AuthCRAMMD5:
+		return smtp.CRAMMD5Auth(username, password)
+	case AuthAuto:
+		return &autoAuth{username: username, password: password, host: host}
+	default:
+		return smtp.PlainAuth("", username, password, host)
+	}
+}
+
+// loginAuth implements the LOGIN mechanism, which net/smtp doesn't provide
+type loginAuth struct {
+	username, password, host string
+	step                     int
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// Like smtp.PlainAuth, never send credentials in the clear to a remote host
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	a.step = 0
+	return AuthLogin, nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	a.step++
+	switch a.step {
+	case 1:
+		return []byte(a.username), nil
+	case 2:
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected LOGIN challenge: %q", fromServer)
+	}
+}
+
+// autoAuth picks a mechanism from the ones the server advertises in EHLO
+type autoAuth struct {
+	username, password, host string
+	auth                     smtp.Auth
+}
+
+func (a *autoAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	advertised := make(map[string]bool, len(server.Auth))
+	for _, mechanism := range server.Auth {
+		advertised[strings.ToUpper(mechanism)] = true
+	}
+	for _, mechanism := range autoAuthPreference {
+		// PLAIN and LOGIN send the password itself, so only use them over TLS
+		if !advertised[mechanism] || (mechanism != AuthCRAMMD5 && !server.TLS && !isLocalhost(server.Name)) {
+			continue
+		}
+		a.auth = newAuth(mechanism, a.username, a.password, a.host)
+		return a.auth.Start(server)
+	}
+	if !server.TLS && (advertised[AuthLogin] || advertised[AuthPlain]) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	return "", nil, fmt.Errorf("smtp: no supported AUTH mechanism, server offers: %s", strings.Join(server.Auth, " "))
+}
+
+func (a *autoAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	return a.auth.Next(fromServer, more)
+}
+
+// isLocalhost reports whether name is the local host
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
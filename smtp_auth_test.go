@@ -0,0 +1,64 @@
+package gosmtpmail
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAuthMechanisms(t *testing.T) {
+	tests := []struct {
+		name       string
+		mechanism  string
+		advertised string
+		want       string
+	}{
+		{"LOGIN", AuthLogin, "AUTH LOGIN", "LOGIN sender@example.com secret"},
+		{"CRAM-MD5", AuthCRAMMD5, "AUTH CRAM-MD5", "CRAM-MD5 sender@example.com"},
+		{"AUTO picks CRAM-MD5", AuthAuto, "AUTH PLAIN LOGIN CRAM-MD5", "CRAM-MD5 sender@example.com"},
+		{"AUTO picks LOGIN", AuthAuto, "AUTH PLAIN LOGIN", "LOGIN sender@example.com secret"},
+		{"AUTO picks PLAIN", AuthAuto, "AUTH PLAIN", "PLAIN  sender@example.com secret"},
+		{"lowercase mechanism", "login", "AUTH LOGIN", "LOGIN sender@example.com secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeServer(t, func(s *fakeServer) { s.extensions = []string{tt.advertised} })
+			config := serverConfig(server)
+			config.AuthMechanism = tt.mechanism
+			useConfig(t, config)
+
+			// 127.0.0.1 counts as localhost, so PLAIN and LOGIN are allowed without TLS
+			if err := Send("Auth", "body", "", "", []string{"jane@example.com"}); err != nil {
+				t.Fatal(err)
+			}
+			if auths := server.Auths(); len(auths) != 1 || auths[0] != tt.want {
+				t.Errorf("server auths = %q, want %q", auths, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthFailures(t *testing.T) {
+	server := newFakeServer(t, func(s *fakeServer) { s.extensions = []string{"AUTH GSSAPI"} })
+	config := serverConfig(server)
+	config.AuthMechanism = AuthAuto
+	useConfig(t, config)
+
+	if err := Send("Auth", "body", "", "", []string{"jane@example.com"}); err == nil || !strings.Contains(err.Error(), "no supported AUTH mechanism") {
+		t.Errorf("AUTO without a supported mechanism returned %v", err)
+	}
+
+	server = newFakeServer(t, func(s *fakeServer) {
+		s.extensions = []string{"AUTH CRAM-MD5"}
+		s.password = "other"
+	})
+	config = serverConfig(server)
+	config.AuthMechanism = AuthCRAMMD5
+	useConfig(t, config)
+	if err := Send("Auth", "body", "", "", []string{"jane@example.com"}); err == nil {
+		t.Error("CRAM-MD5 with the wrong password succeeded")
+	}
+
+	if err := ValidateConfig(EmailConfig{AuthMechanism: "XOAUTH2"}); err == nil {
+		t.Error("unsupported mechanism accepted")
+	}
+}
@@ -0,0 +1,81 @@
+package gosmtpmail
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// defaultCircuitBreakerCooldown is used when CircuitBreakerCooldown isn't set
+const defaultCircuitBreakerCooldown = 30 * time.Second
+
+// circuitBreaker fast-fails sends after consecutive transport failures
+type circuitBreaker struct {
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+var circuit circuitBreaker
+
+// allow returns ErrCircuitOpen while the breaker is open. Once the cooldown
+// has passed a single trial send is let through to probe the server.
+func (b *circuitBreaker) allow() error {
+	threshold := emailConfig.CircuitBreakerThreshold
+	if threshold <= 0 {
+		return nil
+	}
+	cooldown := emailConfig.CircuitBreakerCooldown
+	if cooldown <= 0 {
+		cooldown = defaultCircuitBreakerCooldown
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < threshold {
+		return nil
+	}
+	if b.trial || time.Since(b.openedAt) < cooldown {
+		return ErrCircuitOpen
+	}
+	b.trial = true
+	return nil
+}
+
+// record counts err towards opening the breaker, closing it again on success
+func (b *circuitBreaker) record(err error) {
+	threshold := emailConfig.CircuitBreakerThreshold
+	if threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if !isTransportFailure(err) {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= threshold {
+		b.openedAt = time.Now()
+	}
+}
+
+// isTransportFailure reports whether err means the server is unreachable or
+// unavailable, rather than that it rejected this particular message
+func isTransportFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code == 421
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,109 @@
+package gosmtpmail
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	// A listener that is closed right away refuses connections
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+
+	server := newFakeServer(t)
+	config := serverConfig(server)
+	config.Host, config.Port = host, port
+	config.CircuitBreakerThreshold = 2
+	config.CircuitBreakerCooldown = 50 * time.Millisecond
+	useConfig(t, config)
+	to := []string{"jane@example.com"}
+
+	// Consecutive transport failures open the breaker
+	for i := 0; i < 2; i++ {
+		if err := Send("Down", "body", "", "", to); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("send %d to a refused port returned %v, want a connect error", i, err)
+		}
+	}
+	if err := Send("Open", "body", "", "", to); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("send after %d failures returned %v, want ErrCircuitOpen", config.CircuitBreakerThreshold, err)
+	}
+
+	// A failed trial send keeps it open for another cooldown
+	time.Sleep(config.CircuitBreakerCooldown)
+	if err := Send("Trial", "body", "", "", to); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("trial send returned %v, want a connect error", err)
+	}
+	if err := Send("Open", "body", "", "", to); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("send after a failed trial returned %v, want ErrCircuitOpen", err)
+	}
+
+	// Once the server is back, the trial send closes the breaker
+	emailConfig.Host, emailConfig.Port = server.hostPort()
+	time.Sleep(config.CircuitBreakerCooldown)
+	for i := 0; i < 3; i++ {
+		if err := Send("Recovered", "body", "", "", to); err != nil {
+			t.Fatalf("send %d after recovery: %v", i, err)
+		}
+	}
+	if len(server.Messages()) != 3 {
+		t.Errorf("server received %d messages, want 3", len(server.Messages()))
+	}
+}
+
+func TestCircuitBreakerIgnoresRejections(t *testing.T) {
+	server := newFakeServer(t, func(s *fakeServer) {
+		s.replies = map[string]string{"RCPT TO:<bounce@": "550 5.1.1 no such user"}
+	})
+	config := serverConfig(server)
+	config.CircuitBreakerThreshold = 1
+	useConfig(t, config)
+
+	for i := 0; i < 2; i++ {
+		if err := Send("Bounced", "body", "", "", []string{"bounce@example.com"}); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("send %d returned %v, want the rejection", i, err)
+		}
+	}
+	if err := Send("Delivered", "body", "", "", []string{"jane@example.com"}); err != nil {
+		t.Errorf("rejected recipients opened the breaker: %v", err)
+	}
+}
+
+func TestCircuitBreakerIgnoresLocalErrors(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+
+	config := EmailConfig{EmailAddress: "sender@example.com", Host: host, Port: port}
+	config.CircuitBreakerThreshold = 2
+	config.CircuitBreakerCooldown = 50 * time.Millisecond
+	useConfig(t, config)
+	to := []string{"jane@example.com"}
+
+	for i := 0; i < 2; i++ {
+		if err := Send("Down", "body", "", "", to); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("send %d to a refused port returned %v, want a connect error", i, err)
+		}
+	}
+
+	// A local validation error while half-open neither uses up the trial nor
+	// closes the breaker
+	time.Sleep(config.CircuitBreakerCooldown)
+	if err := Send("Invalid", "body", "", "", to, WithHeloName("bad name")); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("send with an invalid HELO name returned %v, want the validation error", err)
+	}
+	if err := Send("Trial", "body", "", "", to); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("trial send returned %v, want a connect error", err)
+	}
+	if err := Send("Open", "body", "", "", to); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("send after the failed trial returned %v, want ErrCircuitOpen", err)
+	}
+}
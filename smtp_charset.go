@@ -0,0 +1,62 @@
+package gosmtpmail
+
+import (
+	"errors"
+	"golang.org/x/text/encoding/ianaindex"
+	"mime"
+	"strings"
+)
+
+// defaultCharset is used when neither the message nor EmailConfig sets one
+const defaultCharset = "UTF-8"
+
+// messageCharset returns the charset for a message, falling back to EmailConfig.Charset
+func messageCharset(options messageOptions) string {
+	if options.charset != "" {
+		return options.charset
+	}
+	if emailConfig.Charset != "" {
+		return emailConfig.Charset
+	}
+	return defaultCharset
+}
+
+// isUTF8Charset reports whether charset names UTF-8
+func isUTF8Charset(charset string) bool {
+	return strings.EqualFold(charset, "UTF-8") || strings.EqualFold(charset, "UTF8")
+}
+
+// transcode converts s from UTF-8 to charset
+func transcode(s, charset string) (string, error) {
+	if isUTF8Charset(charset) {
+		return s, nil
+	}
+	encoding, err := ianaindex.MIME.Encoding(charset)
+	if err != nil || encoding == nil {
+		return "", errors.New("unsupported charset: " + charset)
+	}
+	encoded, err := encoding.NewEncoder().String(s)
+	if err != nil {
+		return "", errors.New("text can't be represented in charset " + charset)
+	}
+	return encoded, nil
+}
+
+// encodeHeaderCharset is encodeHeader for a charset other than UTF-8
+func encodeHeaderCharset(header, charset string) (string, error) {
+	if isUTF8Charset(charset) {
+		return encodeHeader(header), nil
+	}
+	transcoded, err := transcode(header, charset)
+	if err != nil {
+		return "", err
+	}
+	encoded := mime.QEncoding.Encode(charset, transcoded)
+	if b := mime.BEncoding.Encode(charset, transcoded); len(b) < len(encoded) {
+		encoded = b
+	}
+	if encoded == transcoded {
+		return header, nil
+	}
+	return strings.ReplaceAll(encoded, "?= =?", "?=\r\n =?"), nil
+}
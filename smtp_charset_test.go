@@ -0,0 +1,40 @@
+package gosmtpmail
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWithCharsetOverride(t *testing.T) {
+	server := newFakeServer(t)
+	useConfig(t, serverConfig(server))
+
+	to := []string{"jane@example.com"}
+	if err := Send("Değişiklik", "Güncelleme ağı", "", "", to, WithCharset("ISO-8859-9")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Send("Değişiklik", "Güncelleme ağı", "", "", to); err != nil {
+		t.Fatal(err)
+	}
+	messages := server.Messages()
+
+	legacy := messages[0]
+	if !strings.Contains(legacy, "Content-Type: text/plain; charset=ISO-8859-9") {
+		t.Errorf("body part doesn't declare ISO-8859-9:\n%s", legacy)
+	}
+	if !strings.Contains(legacy, "Subject: =?ISO-8859-9?") {
+		t.Errorf("subject isn't encoded as ISO-8859-9:\n%s", legacy)
+	}
+	// "ağı" is 0x61 0xF0 0xFD in ISO-8859-9
+	if !strings.Contains(legacy, "G\xfcncelleme a\xf0\xfd") {
+		t.Errorf("body isn't transcoded to ISO-8859-9:\n%q", legacy)
+	}
+
+	if !strings.Contains(messages[1], "charset=UTF-8") || !strings.Contains(messages[1], "Güncelleme ağı") {
+		t.Errorf("message without the override isn't UTF-8:\n%s", messages[1])
+	}
+
+	if err := Send("Subject", "body", "", "", to, WithCharset("X-NO-SUCH-CHARSET")); err == nil {
+		t.Error("unknown charset accepted")
+	}
+}
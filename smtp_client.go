@@ -0,0 +1,435 @@
+package gosmtpmail
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/mehmetdenizer/gohelpers"
+	"io"
+	"net"
+	"net/smtp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLSMode selects how the connection to the SMTP server is secured
+type TLSMode string
+
+const (
+	// TLSModeAuto picks the mode from the configured port (see resolveTLSMode)
+	TLSModeAuto TLSMode = ""
+	// TLSModeImplicit connects over TLS from the start (SMTPS)
+	TLSModeImplicit TLSMode = "implicit"
+	// TLSModeStartTLS upgrades with STARTTLS and fails if the server doesn't offer it
+	TLSModeStartTLS TLSMode = "starttls"
+	// TLSModeOpportunistic upgrades with STARTTLS only when the server offers it
+	TLSModeOpportunistic TLSMode = "opportunistic"
+	// TLSModeNone never uses TLS
+	TLSModeNone TLSMode = "none"
+)
+
+// tlsSessionCache is shared by all connections so later sends can resume TLS
+// sessions instead of doing a full handshake. It is created on first use and
+// rebuilt when TLSSessionCacheSize changes.
+var tlsSessionCache struct {
+	mu    sync.Mutex
+	cache tls.ClientSessionCache
+	size  int
+}
+
+// sessionCache returns the shared TLS session cache, or nil when
+// TLSSessionCacheSize disables resumption
+func sessionCache() tls.ClientSessionCache {
+	size := emailConfig.TLSSessionCacheSize
+	if size < 0 {
+		return nil
+	}
+	tlsSessionCache.mu.Lock()
+	defer tlsSessionCache.mu.Unlock()
+	if tlsSessionCache.cache == nil || tlsSessionCache.size != size {
+		tlsSessionCache.cache = tls.NewLRUClientSessionCache(size)
+		tlsSessionCache.size = size
+	}
+	return tlsSessionCache.cache
+}
+
+// defaultDataBufferSize is the DATA write buffer size used when DataBufferSize isn't set
+const defaultDataBufferSize = 32 << 10
+
+// resolveTLSMode returns the configured TLS mode, deriving it from the port
+// when no explicit mode is set: 465 uses implicit TLS, 587 requires STARTTLS
+// and any other port (including 25) uses opportunistic STARTTLS.
+func resolveTLSMode() TLSMode {
+	if emailConfig.TLSMode != TLSModeAuto {
+		return emailConfig.TLSMode
+	}
+	switch emailConfig.Port {
+	case "465":
+		return TLSModeImplicit
+	case "587":
+		return TLSModeStartTLS
+	default:
+		return TLSModeOpportunistic
+	}
+}
+
+// sendMail sends msg through the configured server, like smtp.SendMail but
+// honoring the TLS mode and the HELO name. When msg contains 8-bit data and
+// the server doesn't advertise 8BITMIME, the message from sevenBitMessage is
+// sent instead. Sends fail with ErrCircuitOpen while the circuit breaker is open.
+func sendMail(addr string, auth smtp.Auth, from string, to []string, msg messageSource, sevenBitMessage func() (messageSource, error), options messageOptions) (err error) {
+	if err := validateLine(from); err != nil {
+		return err
+	}
+	for _, recipient := range to {
+		if err := validateLine(recipient); err != nil {
+			return err
+		}
+	}
+
+	localName := emailConfig.LocalName
+	if options.heloName != "" {
+		localName = options.heloName
+	}
+	if localName == "" {
+		localName = "localhost"
+	}
+	if err := validateHostname(localName); err != nil {
+		return err
+	}
+
+	mode := resolveTLSMode()
+	tlsConfig := &tls.Config{ServerName: emailConfig.Host, RootCAs: emailConfig.RootCAs, ClientSessionCache: sessionCache()}
+
+	// Connect
+	network := emailConfig.DialNetwork
+	if network == "" {
+		network = "tcp"
+	}
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return phaseError(PhaseConnect, addr, errors.New("invalid dial network: "+network))
+	}
+
+	// Only the dial and the SMTP exchange count towards the circuit breaker
+	if err = circuit.allow(); err != nil {
+		return err
+	}
+	defer func() {
+		circuit.record(err)
+	}()
+	conn, err := dial(network, addr, mode, tlsConfig)
+	if err != nil {
+		return phaseError(PhaseConnect, addr, err)
+	}
+
+	// Debug transcript; the greeting is logged from the connection itself
+	var transcript *debugTranscript
+	var greeting *greetingConn
+	clientConn := conn
+	if emailConfig.DebugWriter != nil {
+		transcript = &debugTranscript{out: emailConfig.DebugWriter}
+		greeting = &greetingConn{Conn: conn, transcript: transcript}
+		clientConn = greeting
+	}
+	client, err := smtp.NewClient(clientConn, emailConfig.Host)
+	if err != nil {
+		conn.Close()
+		return phaseError(PhaseConnect, addr, err)
+	}
+	defer client.Close()
+	if transcript != nil {
+		greeting.done = true
+		attachDebugTranscript(client, transcript)
+	}
+
+	// net/smtp can't see an implicit TLS connection behind greetingConn
+	implicitConn, implicitTLS := conn.(*tls.Conn)
+	tlsConnectionState := func() (tls.ConnectionState, bool) {
+		if implicitTLS {
+			return implicitConn.ConnectionState(), true
+		}
+		return client.TLSConnectionState()
+	}
+	if implicitTLS && transcript != nil && auth != nil {
+		auth = implicitTLSAuth{auth}
+	}
+
+	// EHLO/HELO
+	if err = client.Hello(localName); err != nil {
+		return phaseError(PhaseEHLO, "EHLO "+localName, err)
+	}
+
+	// STARTTLS
+	if mode == TLSModeStartTLS || mode == TLSModeOpportunistic {
+		ok, _ := client.Extension("STARTTLS")
+		if ok {
+			if err = client.StartTLS(tlsConfig); err != nil {
+				return phaseError(PhaseStartTLS, "STARTTLS", tlsVerificationError(err, tlsConfig.ServerName))
+			}
+			if transcript != nil {
+				attachDebugTranscript(client, transcript)
+			}
+		} else if mode == TLSModeStartTLS {
+			return phaseError(PhaseStartTLS, "STARTTLS", errors.New("smtp: server doesn't support STARTTLS"))
+		}
+	}
+
+	// Report the TLS handshake, including whether the session was resumed
+	if state, ok := tlsConnectionState(); ok {
+		if transcript != nil {
+			transcript.info(fmt.Sprintf("TLS session resumed: %t", state.DidResume))
+		}
+		if emailConfig.OnTLSHandshake != nil {
+			emailConfig.OnTLSHandshake(state)
+		}
+	}
+
+	// Auth
+	if auth != nil {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return phaseError(PhaseAuth, "AUTH", errors.New("smtp: server doesn't support AUTH"))
+		}
+		if err = client.Auth(auth); err != nil {
+			// smtp.PlainAuth refuses plaintext connections with an untyped error
+			if err.Error() == "unencrypted connection" {
+				err = ErrUnencryptedAuthRefused
+			}
+			return phaseError(PhaseAuth, "AUTH", err)
+		}
+	}
+
+	// 8BITMIME; client.Mail adds BODY=8BITMIME itself when it is advertised
+	if ok, _ := client.Extension("8BITMIME"); !ok && !msg.isASCII() && sevenBitMessage != nil {
+		if msg, err = sevenBitMessage(); err != nil {
+			return err
+		}
+	}
+
+	// Envelope
+	params, err := mailFromParams(client, from, to, options)
+	if err != nil {
+		return phaseError(PhaseMail, "MAIL FROM:<"+from+">", err)
+	}
+	if len(params) == 0 {
+		if err = client.Mail(from); err != nil {
+			return phaseError(PhaseMail, "MAIL FROM:<"+from+">", err)
+		}
+	} else if err = mailWithParams(client, from, params); err != nil {
+		return phaseError(PhaseMail, "MAIL FROM:<"+from+"> "+params, err)
+	}
+	for _, recipient := range to {
+		if err = client.Rcpt(recipient); err != nil {
+			return phaseError(PhaseRcpt, "RCPT TO:<"+recipient+">", err)
+		}
+	}
+
+	// Data
+	writer, err := client.Data()
+	if err != nil {
+		return phaseError(PhaseData, "DATA", err)
+	}
+	bufferSize := emailConfig.DataBufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultDataBufferSize
+	}
+	var dataWriter io.Writer = writer
+	if emailConfig.DataIdleTimeout > 0 {
+		dataWriter = &idleTimeoutWriter{w: writer, conn: conn, timeout: emailConfig.DataIdleTimeout}
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+	buffered := bufio.NewWriterSize(dataWriter, bufferSize)
+	if err = msg.writeTo(buffered); err == nil {
+		err = buffered.Flush()
+	}
+	if err != nil {
+		// Drop the connection without terminating DATA so the server discards the partial message
+		client.Close()
+		return phaseError(PhaseData, "DATA", fmt.Errorf("message aborted mid-DATA: %w", err))
+	}
+	if emailConfig.DataIdleTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(emailConfig.DataIdleTimeout))
+	}
+	if err = writer.Close(); err != nil {
+		return phaseError(PhaseData, ".", err)
+	}
+	if err = client.Quit(); err != nil {
+		return phaseError(PhaseQuit, "QUIT", err)
+	}
+	return nil
+}
+
+// dial connects to addr using EmailConfig.Dial when set, securing the
+// connection for implicit TLS
+func dial(network, addr string, mode TLSMode, tlsConfig *tls.Config) (net.Conn, error) {
+	if emailConfig.Dial == nil {
+		if mode == TLSModeImplicit {
+			conn, err := tls.Dial(network, addr, tlsConfig)
+			if err != nil {
+				return nil, tlsVerificationError(err, tlsConfig.ServerName)
+			}
+			return conn, nil
+		}
+		return net.Dial(network, addr)
+	}
+
+	conn, err := emailConfig.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	_, isTLS := conn.(*tls.Conn)
+	switch {
+	case mode == TLSModeImplicit && !isTLS:
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, tlsVerificationError(err, tlsConfig.ServerName)
+		}
+		return tlsConn, nil
+	case isTLS && mode != TLSModeImplicit:
+		conn.Close()
+		return nil, fmt.Errorf("dialer returned a TLS connection but the TLS mode is %q", mode)
+	}
+	return conn, nil
+}
+
+// idleTimeoutWriter extends the connection's write deadline before every
+// write, so writing fails once the server stops accepting data for timeout
+type idleTimeoutWriter struct {
+	w       io.Writer
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (w *idleTimeoutWriter) Write(p []byte) (int, error) {
+	if err := w.conn.SetWriteDeadline(time.Now().Add(w.timeout)); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// mailFromParamExtensions maps MAIL FROM parameters to the EHLO extension that enables them
+var mailFromParamExtensions = map[string]string{
+	"BODY":  "8BITMIME",
+	"RET":   "DSN",
+	"ENVID": "DSN",
+}
+
+// mailFromParams returns the configured MAIL FROM parameters supported by the
+// server, formatted as they appear on the wire
+func mailFromParams(client *smtp.Client, from string, to []string, options messageOptions) (string, error) {
+	merged := make(map[string]string)
+	for keyword, value := range emailConfig.MailFromParams {
+		merged[strings.ToUpper(keyword)] = value
+	}
+	for keyword, value := range options.mailFromParams {
+		merged[strings.ToUpper(keyword)] = value
+	}
+
+	// Non-ASCII addresses need SMTPUTF8 (RFC 6531)
+	utf8Addresses := !isASCII(from + strings.Join(to, ""))
+	if ok, _ := client.Extension("SMTPUTF8"); utf8Addresses && !ok {
+		return "", errors.New("smtp: server doesn't support SMTPUTF8, which non-ASCII addresses require")
+	}
+	if len(merged) == 0 {
+		return "", nil
+	}
+
+	// BODY=8BITMIME and SMTPUTF8 are added the way client.Mail would
+	if _, ok := merged["BODY"]; !ok {
+		if ok, _ := client.Extension("8BITMIME"); ok {
+			merged["BODY"] = "8BITMIME"
+		}
+	}
+	if utf8Addresses {
+		merged["SMTPUTF8"] = ""
+	}
+
+	keywords := make([]string, 0, len(merged))
+	for keyword := range merged {
+		keywords = append(keywords, keyword)
+	}
+	sort.Strings(keywords)
+
+	var params []string
+	for _, keyword := range keywords {
+		value := merged[keyword]
+		if !isESMTPKeyword(keyword) || !isXText(value) {
+			return "", fmt.Errorf("invalid MAIL FROM parameter %s=%s", keyword, value)
+		}
+		extension := keyword
+		if mapped, ok := mailFromParamExtensions[keyword]; ok {
+			extension = mapped
+		}
+		if ok, _ := client.Extension(extension); !ok {
+			if emailConfig.StrictMailFromParams {
+				return "", errors.New("smtp: server doesn't support MAIL FROM parameter " + keyword)
+			}
+			gohelpers.LogWarning("Dropping unsupported MAIL FROM parameter: " + keyword)
+			continue
+		}
+		if value == "" {
+			params = append(params, keyword)
+		} else {
+			params = append(params, keyword+"="+value)
+		}
+	}
+	return strings.Join(params, " "), nil
+}
+
+// mailWithParams issues MAIL FROM with ESMTP parameters, which client.Mail can't send
+func mailWithParams(client *smtp.Client, from, params string) error {
+	id, err := client.Text.Cmd("MAIL FROM:<%s> %s", from, params)
+	if err != nil {
+		return err
+	}
+	client.Text.StartResponse(id)
+	defer client.Text.EndResponse(id)
+	_, _, err = client.Text.ReadResponse(250)
+	return err
+}
+
+// isESMTPKeyword checks the esmtp-keyword grammar of RFC 5321
+func isESMTPKeyword(keyword string) bool {
+	if keyword == "" || keyword[0] == '-' {
+		return false
+	}
+	for _, r := range keyword {
+		if !(r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// isXText checks that value is valid RFC 3461 xtext
+func isXText(value string) bool {
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '+':
+			if i+2 >= len(value) || !isUpperHex(value[i+1]) || !isUpperHex(value[i+2]) {
+				return false
+			}
+			i += 2
+		case c < '!' || c > '~' || c == '=':
+			return false
+		}
+	}
+	return true
+}
+
+// isUpperHex reports whether c is an uppercase hexadecimal digit
+func isUpperHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'A' && c <= 'F'
+}
+
+// validateLine checks that a line doesn't contain CR or LF
+func validateLine(line string) error {
+	if strings.ContainsAny(line, "\r\n") {
+		return errors.New("smtp: a line must not contain CR or LF")
+	}
+	return nil
+}
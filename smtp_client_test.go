@@ -0,0 +1,502 @@
+package gosmtpmail
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEightBitMIMENegotiation(t *testing.T) {
+	tests := []struct {
+		name       string
+		extensions []string
+		wantParam  bool
+		wantCTE    string
+	}{
+		{"advertised", []string{"8BITMIME", "AUTH PLAIN"}, true, "Content-Transfer-Encoding: 8bit"},
+		{"not advertised", []string{"AUTH PLAIN"}, false, "Content-Transfer-Encoding: quoted-printable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeServer(t, func(s *fakeServer) { s.extensions = tt.extensions })
+			useConfig(t, serverConfig(server))
+
+			if err := Send("Grüße", "Schöne Grüße aus Köln", "", "", []string{"jane@example.com"}); err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Contains(server.command("MAIL FROM:"), "BODY=8BITMIME"); got != tt.wantParam {
+				t.Errorf("MAIL FROM = %q, BODY=8BITMIME present %v, want %v", server.command("MAIL FROM:"), got, tt.wantParam)
+			}
+			message := server.Messages()[0]
+			if !strings.Contains(message, tt.wantCTE) {
+				t.Errorf("message doesn't declare %q:\n%s", tt.wantCTE, message)
+			}
+			if !tt.wantParam && !isASCII(message) {
+				t.Errorf("message isn't 7-bit clean for a server without 8BITMIME:\n%s", message)
+			}
+		})
+	}
+}
+
+func TestDebugCopyWithoutEightBitMIME(t *testing.T) {
+	server := newFakeServer(t, func(s *fakeServer) { s.extensions = []string{"AUTH PLAIN"} })
+	config := serverConfig(server)
+	config.BccAddressToSendCopy = "debug@example.com"
+	config.AttachSourceToBccCopy = true
+	useConfig(t, config)
+
+	if err := Send("Grüße", "Schöne Grüße", "", "", []string{"jane@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	messages := server.Messages()
+	if len(messages) != 2 {
+		t.Fatalf("got %d messages, want the message and its debug copy", len(messages))
+	}
+	for _, message := range messages {
+		if !isASCII(message) {
+			t.Errorf("message isn't 7-bit clean for a server without 8BITMIME:\n%s", message)
+		}
+	}
+}
+
+func TestMailFromParamsOnTheWire(t *testing.T) {
+	server := newFakeServer(t, func(s *fakeServer) {
+		s.extensions = []string{"8BITMIME", "DSN", "AUTH PLAIN"}
+	})
+	config := serverConfig(server)
+	config.MailFromParams = map[string]string{"ret": "HDRS", "MT-PRIORITY": "3"}
+	useConfig(t, config)
+
+	if err := Send("Params", "body", "", "", []string{"jane@example.com"}, WithMailFromParams(map[string]string{"ENVID": "order+2B42"})); err != nil {
+		t.Fatal(err)
+	}
+	// MT-PRIORITY isn't advertised, so it is dropped
+	if got, want := server.command("MAIL FROM:"), "MAIL FROM:<sender@example.com> BODY=8BITMIME ENVID=order+2B42 RET=HDRS"; got != want {
+		t.Errorf("MAIL FROM = %q, want %q", got, want)
+	}
+
+	emailConfig.StrictMailFromParams = true
+	if err := Send("Params", "body", "", "", []string{"jane@example.com"}); err == nil {
+		t.Error("unsupported parameter accepted with StrictMailFromParams")
+	}
+	emailConfig.StrictMailFromParams = false
+	if err := Send("Params", "body", "", "", []string{"jane@example.com"}, WithMailFromParams(map[string]string{"ENVID": "bad value"})); err == nil {
+		t.Error("parameter value that isn't xtext accepted")
+	}
+}
+
+func TestMailFromParamsSMTPUTF8(t *testing.T) {
+	server := newFakeServer(t, func(s *fakeServer) {
+		s.extensions = []string{"8BITMIME", "DSN", "SMTPUTF8", "AUTH PLAIN"}
+	})
+	useConfig(t, serverConfig(server))
+
+	opts := WithMailFromParams(map[string]string{"RET": "FULL"})
+	if err := Send("Params", "body", "", "", []string{"jane@example.com"}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.command("MAIL FROM:"); strings.Contains(got, "SMTPUTF8") {
+		t.Errorf("SMTPUTF8 sent for ASCII addresses: %q", got)
+	}
+
+	if err := Send("Params", "body", "", "", []string{"jürgen@example.com"}, opts); err != nil {
+		t.Fatal(err)
+	}
+	commands := server.Commands()
+	var last string
+	for _, command := range commands {
+		if strings.HasPrefix(command, "MAIL FROM:") {
+			last = command
+		}
+	}
+	if !strings.HasSuffix(last, " SMTPUTF8") {
+		t.Errorf("MAIL FROM for a non-ASCII recipient = %q, want SMTPUTF8", last)
+	}
+}
+
+func TestSMTPUTF8NotOffered(t *testing.T) {
+	server := newFakeServer(t)
+	useConfig(t, serverConfig(server))
+
+	err := Send("Params", "body", "", "", []string{"jürgen@example.com"})
+	if err == nil || !strings.Contains(err.Error(), "SMTPUTF8") {
+		t.Errorf("non-ASCII recipient without SMTPUTF8 returned %v", err)
+	}
+}
+
+func TestDialNetwork(t *testing.T) {
+	server := newFakeServer(t)
+	var networks []string
+	config := serverConfig(server)
+	config.Dial = func(network, addr string) (net.Conn, error) {
+		networks = append(networks, network)
+		return net.Dial("tcp", addr)
+	}
+	useConfig(t, config)
+
+	if err := Send("Default", "body", "", "", []string{"jane@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	emailConfig.DialNetwork = "tcp4"
+	if err := Send("IPv4", "body", "", "", []string{"jane@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(networks, ",") != "tcp,tcp4" {
+		t.Errorf("dialer got networks %q, want [tcp tcp4]", networks)
+	}
+
+	emailConfig.DialNetwork = "udp"
+	if err := Send("Invalid", "body", "", "", []string{"jane@example.com"}); err == nil {
+		t.Error("invalid dial network accepted")
+	}
+	if len(networks) != 2 {
+		t.Error("dialer called with an invalid network")
+	}
+}
+
+func TestDialPipe(t *testing.T) {
+	server := newFakeServer(t)
+	config := serverConfig(server)
+	// PlainAuth only sends the password in the clear to localhost
+	config.Host = "localhost"
+	config.Dial = func(network, addr string) (net.Conn, error) {
+		client, serverSide := net.Pipe()
+		go server.serve(serverSide)
+		return client, nil
+	}
+	useConfig(t, config)
+
+	if err := Send("Piped", "over a pipe", "", "", []string{"jane@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	messages := server.Messages()
+	if len(messages) != 1 || !strings.Contains(messages[0], "over a pipe") {
+		t.Errorf("server received %q, want the piped message", messages)
+	}
+	if server.command("QUIT") == "" {
+		t.Errorf("session over the pipe didn't end with QUIT: %q", server.Commands())
+	}
+}
+
+func TestDialTLSExpectations(t *testing.T) {
+	config := EmailConfig{EmailAddress: "sender@example.com", Host: "pipe.test", Port: "25", TLSMode: TLSModeNone}
+	config.Dial = func(network, addr string) (net.Conn, error) {
+		client, _ := net.Pipe()
+		return tls.Client(client, &tls.Config{ServerName: "pipe.test"}), nil
+	}
+	useConfig(t, config)
+
+	err := Send("Mismatch", "body", "", "", []string{"jane@example.com"})
+	var smtpErr *SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Phase != PhaseConnect || !strings.Contains(err.Error(), "TLS mode") {
+		t.Errorf("TLS connection with TLSModeNone returned %v, want a connect error", err)
+	}
+}
+
+func TestRcptRejectionError(t *testing.T) {
+	server := newFakeServer(t, func(s *fakeServer) {
+		s.replies = map[string]string{"RCPT TO:<bad": "550 5.1.1 no such user"}
+	})
+	useConfig(t, serverConfig(server))
+
+	err := Send("Rejected", "body", "", "", []string{"bad@example.com"})
+	if err == nil {
+		t.Fatal("rejected recipient accepted")
+	}
+	for _, want := range []string{"phase=RCPT", `cmd="RCPT TO:<bad@example.com>"`, "550"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't contain %s", err, want)
+		}
+	}
+	var smtpErr *SMTPError
+	if !errors.As(err, &smtpErr) {
+		t.Fatalf("error %v isn't an *SMTPError", err)
+	}
+	if smtpErr.Phase != PhaseRcpt || smtpErr.Command != "RCPT TO:<bad@example.com>" {
+		t.Errorf("SMTPError phase = %s, command = %q, want RCPT and the rejected command", smtpErr.Phase, smtpErr.Command)
+	}
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) || protoErr.Code != 550 {
+		t.Errorf("error %v doesn't wrap the 550 reply", err)
+	}
+}
+
+// failingConn fails writes once limit bytes were written after the DATA command
+type failingConn struct {
+	net.Conn
+	inData  bool
+	written int
+	limit   int
+}
+
+func (c *failingConn) Write(p []byte) (int, error) {
+	if c.inData {
+		if c.written+len(p) > c.limit {
+			return 0, errors.New("injected write failure")
+		}
+		c.written += len(p)
+	} else if string(p) == "DATA\r\n" {
+		c.inData = true
+	}
+	return c.Conn.Write(p)
+}
+
+func TestAbortOnMidDataWriteFailure(t *testing.T) {
+	server := newFakeServer(t)
+	prefix, path := writeAttachment(t, "large.bin", bytes.Repeat([]byte("0123456789"), 50000))
+	config := serverConfig(server)
+	config.AttachmentPathPrefix = prefix
+	config.StreamAttachments = true
+	config.DataBufferSize = 4096
+	config.Dial = func(network, addr string) (net.Conn, error) {
+		conn, err := net.Dial(network, addr)
+		return &failingConn{Conn: conn, limit: 100000}, err
+	}
+	useConfig(t, config)
+
+	err := Send("Large", "text", "", path, []string{"jane@example.com"})
+	var smtpErr *SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Phase != PhaseData || !strings.Contains(err.Error(), "aborted mid-DATA") {
+		t.Fatalf("send with a failing connection returned %v, want an aborted DATA error", err)
+	}
+
+	// The DATA isn't terminated, so the server discards the partial message
+	if messages := server.Messages(); len(messages) != 0 {
+		t.Errorf("server received %d messages, want the partial one discarded", len(messages))
+	}
+}
+
+func TestDataIdleTimeout(t *testing.T) {
+	server := newFakeServer(t, func(s *fakeServer) { s.stallData = true })
+	// Large enough to fill the socket buffers once the server stops reading
+	prefix, path := writeAttachment(t, "large.bin", bytes.Repeat([]byte("0123456789abcdef"), 1<<20))
+	config := serverConfig(server)
+	config.AttachmentPathPrefix = prefix
+	config.StreamAttachments = true
+	config.DataIdleTimeout = 200 * time.Millisecond
+	useConfig(t, config)
+
+	start := time.Now()
+	err := Send("Stalled", "text", "", path, []string{"jane@example.com"})
+	var smtpErr *SMTPError
+	var netErr net.Error
+	if !errors.As(err, &smtpErr) || smtpErr.Phase != PhaseData || !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("send to a stalled server returned %v, want a DATA timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("send took %s to time out", elapsed)
+	}
+}
+
+func TestUnencryptedAuthRefused(t *testing.T) {
+	server := newFakeServer(t)
+	config := serverConfig(server)
+	// PlainAuth only allows plaintext to localhost, so dial the server under another name
+	config.Host = "smtp.example.com"
+	addr := server.listener.Addr().String()
+	config.Dial = func(network, _ string) (net.Conn, error) {
+		return net.Dial(network, addr)
+	}
+	useConfig(t, config)
+
+	err := Send("Plaintext", "body", "", "", []string{"jane@example.com"})
+	var smtpErr *SMTPError
+	if !errors.Is(err, ErrUnencryptedAuthRefused) || !errors.As(err, &smtpErr) || smtpErr.Phase != PhaseAuth {
+		t.Fatalf("plaintext AUTH returned %v, want ErrUnencryptedAuthRefused", err)
+	}
+	if len(server.Auths()) != 0 || server.command("AUTH") != "" {
+		t.Errorf("credentials sent over plaintext: %q", server.Commands())
+	}
+}
+
+func TestTLSSessionResumption(t *testing.T) {
+	tlsConfig, roots := selfSignedTLS(t, "127.0.0.1")
+	server := newFakeServer(t, func(s *fakeServer) { s.tlsConfig = tlsConfig })
+
+	for _, tt := range []struct {
+		name      string
+		cacheSize int
+		want      []bool
+	}{
+		{"default cache", 0, []bool{false, true}},
+		{"disabled", -1, []bool{false, false}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var resumed []bool
+			config := serverConfig(server)
+			config.TLSMode = TLSModeStartTLS
+			config.RootCAs = roots
+			config.TLSSessionCacheSize = tt.cacheSize
+			config.OnTLSHandshake = func(state tls.ConnectionState) {
+				resumed = append(resumed, state.DidResume)
+			}
+			useConfig(t, config)
+
+			for i := 0; i < 2; i++ {
+				if err := Send("Resumed", "body", "", "", []string{"jane@example.com"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if fmt.Sprint(resumed) != fmt.Sprint(tt.want) {
+				t.Errorf("DidResume = %v, want %v", resumed, tt.want)
+			}
+		})
+	}
+}
+
+func TestImplicitTLSWithDebugWriter(t *testing.T) {
+	tlsConfig, roots := selfSignedTLS(t, "mail.test")
+	server := newFakeServer(t, func(s *fakeServer) {
+		s.tlsConfig = tlsConfig
+		s.implicitTLS = true
+	})
+	var out bytes.Buffer
+	config := serverConfig(server)
+	// PlainAuth only sends the password to other hosts when it knows the
+	// connection is encrypted, which greetingConn hides from net/smtp
+	config.Host = "mail.test"
+	addr := server.listener.Addr().String()
+	config.Dial = func(network, _ string) (net.Conn, error) {
+		return net.Dial(network, addr)
+	}
+	config.TLSMode = TLSModeImplicit
+	config.RootCAs = roots
+	config.DebugWriter = &out
+	useConfig(t, config)
+
+	if err := Send("Implicit", "body", "", "", []string{"jane@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if auths := server.Auths(); len(auths) != 1 || auths[0] != "PLAIN  sender@example.com secret" {
+		t.Errorf("server auths = %q, want one PLAIN exchange", auths)
+	}
+	for _, want := range []string{"S: 220 fake.test ESMTP\n", "* TLS session resumed: false\n", "C: AUTH PLAIN [redacted]\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("transcript is missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestTLSVerificationError(t *testing.T) {
+	for _, mode := range []TLSMode{TLSModeImplicit, TLSModeStartTLS} {
+		t.Run(string(mode), func(t *testing.T) {
+			tlsConfig, roots := selfSignedTLS(t, "other.test", "10.0.0.1")
+			server := newFakeServer(t, func(s *fakeServer) {
+				s.tlsConfig = tlsConfig
+				s.implicitTLS = mode == TLSModeImplicit
+			})
+			config := serverConfig(server)
+			config.Host = "mail.test"
+			addr := server.listener.Addr().String()
+			config.Dial = func(network, _ string) (net.Conn, error) {
+				return net.Dial(network, addr)
+			}
+			config.TLSMode = mode
+			config.RootCAs = roots
+			useConfig(t, config)
+
+			err := Send("Mismatch", "body", "", "", []string{"jane@example.com"})
+			var verifyErr *TLSVerificationError
+			if !errors.As(err, &verifyErr) {
+				t.Fatalf("send with a wrong-host certificate returned %v, want a TLSVerificationError", err)
+			}
+			if verifyErr.Host != "mail.test" || verifyErr.Subject != "CN=other.test" || verifyErr.Issuer != "CN=other.test" {
+				t.Errorf("got host %q, subject %q, issuer %q", verifyErr.Host, verifyErr.Subject, verifyErr.Issuer)
+			}
+			if fmt.Sprint(verifyErr.SANs) != "[other.test 10.0.0.1]" {
+				t.Errorf("SANs = %q, want [other.test 10.0.0.1]", verifyErr.SANs)
+			}
+			var hostnameErr x509.HostnameError
+			if !errors.As(err, &hostnameErr) {
+				t.Errorf("error doesn't unwrap to an x509.HostnameError: %v", err)
+			}
+			if len(server.Messages()) != 0 {
+				t.Error("message sent over an unverified connection")
+			}
+		})
+	}
+}
+
+// attachmentData returns the decoded attachment of a delivered message
+func attachmentData(t testing.TB, message string) []byte {
+	t.Helper()
+	msg := parseMessage(t, []byte(message))
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatalf("no attachment part: %v", err)
+		}
+		if part.FileName() != "" {
+			data, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, part))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return data
+		}
+	}
+}
+
+func TestDataBufferSizes(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 20000)
+	for _, size := range []int{0, 1, 7, 512, 4096, 1 << 20} {
+		t.Run(fmt.Sprintf("size %d", size), func(t *testing.T) {
+			server := newFakeServer(t)
+			prefix, path := writeAttachment(t, "large.bin", data)
+			config := serverConfig(server)
+			config.AttachmentPathPrefix = prefix
+			config.StreamAttachments = true
+			config.DataBufferSize = size
+			useConfig(t, config)
+
+			if err := Send("Buffered", "text", "", path, []string{"jane@example.com"}); err != nil {
+				t.Fatal(err)
+			}
+			messages := server.Messages()
+			if len(messages) != 1 {
+				t.Fatalf("got %d messages, want 1", len(messages))
+			}
+			if !bytes.Equal(attachmentData(t, messages[0]), data) {
+				t.Error("attachment differs from the file")
+			}
+		})
+	}
+}
+
+func BenchmarkSendMailDataBuffer(b *testing.B) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 256<<10)
+	for _, size := range []int{512, 4 << 10, 32 << 10, 256 << 10} {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			server := newFakeServer(b, func(s *fakeServer) { s.discardData = true })
+			prefix, path := writeAttachment(b, "large.bin", data)
+			config := serverConfig(server)
+			config.AttachmentPathPrefix = prefix
+			config.StreamAttachments = true
+			config.DataBufferSize = size
+			useConfig(b, config)
+
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := Send("Benchmark", "text", "", path, []string{"jane@example.com"}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
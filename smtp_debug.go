@@ -0,0 +1,157 @@
+package gosmtpmail
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+)
+
+// debugTranscript writes the SMTP conversation to an io.Writer with
+// credentials redacted and the message data summarized
+type debugTranscript struct {
+	mu  sync.Mutex
+	out io.Writer
+	// partial holds the unfinished line of each direction, so redaction
+	// always sees complete lines
+	partial map[string]string
+	// redactNext is set by a 334 challenge, whose answer carries credentials
+	redactNext bool
+	// dataRequested is set by the DATA command and inData by its 354 reply
+	dataRequested bool
+	inData        bool
+	dataBytes     int
+}
+
+// debugReader logs everything read from the server
+type debugReader struct {
+	transcript *debugTranscript
+	r          io.Reader
+}
+
+// debugWriter logs everything written by the client
+type debugWriter struct {
+	transcript *debugTranscript
+	w          *bufio.Writer
+}
+
+// greetingConn logs the server greeting, which smtp.NewClient reads before
+// the text connection can be hooked
+type greetingConn struct {
+	net.Conn
+	transcript *debugTranscript
+	done       bool
+}
+
+// implicitTLSAuth tells an smtp.Auth the connection is encrypted when an
+// implicit TLS connection is wrapped in a greetingConn, which hides it from net/smtp
+type implicitTLSAuth struct {
+	smtp.Auth
+}
+
+func (a implicitTLSAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	info := *server
+	info.TLS = true
+	return a.Auth.Start(&info)
+}
+
+// attachDebugTranscript hooks client's text connection so the conversation is
+// written to out. It must be called again after STARTTLS, which replaces the
+// text connection.
+func attachDebugTranscript(client *smtp.Client, transcript *debugTranscript) {
+	client.Text.Reader.R = bufio.NewReader(debugReader{transcript: transcript, r: client.Text.Reader.R})
+	client.Text.Writer.W = bufio.NewWriter(debugWriter{transcript: transcript, w: client.Text.Writer.W})
+}
+
+func (d debugReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if n > 0 {
+		d.transcript.log("S: ", string(p[:n]))
+	}
+	return n, err
+}
+
+func (d debugWriter) Write(p []byte) (int, error) {
+	d.transcript.log("C: ", string(p))
+	n, err := d.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, d.w.Flush()
+}
+
+func (c *greetingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 && !c.done {
+		c.transcript.log("S: ", string(p[:n]))
+	}
+	return n, err
+}
+
+// log buffers chunk and writes each complete line with the given prefix
+func (t *debugTranscript) log(prefix, chunk string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.partial == nil {
+		t.partial = make(map[string]string)
+	}
+	pending := t.partial[prefix] + chunk
+	for {
+		end := strings.IndexByte(pending, '\n')
+		if end < 0 {
+			break
+		}
+		t.line(prefix, strings.TrimRight(pending[:end], "\r"))
+		pending = pending[end+1:]
+	}
+	t.partial[prefix] = pending
+}
+
+// info writes a note about the connection
+func (t *debugTranscript) info(message string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprintf(t.out, "* %s\n", message)
+}
+
+// line writes a complete line, redacting AUTH payloads and summarizing the
+// message data between the 354 reply and the terminating dot
+func (t *debugTranscript) line(prefix, line string) {
+	if prefix == "C: " {
+		if t.inData {
+			if line != "." {
+				t.dataBytes += len(line) + 2
+				return
+			}
+			fmt.Fprintf(t.out, "C: [message data, %d bytes]\n", t.dataBytes)
+			t.inData, t.dataBytes = false, 0
+		}
+		line = t.redact(line)
+		t.dataRequested = strings.EqualFold(line, "DATA")
+	} else if prefix == "S: " {
+		// A 334 challenge means the next client line carries credentials
+		t.redactNext = strings.HasPrefix(line, "334")
+		if t.dataRequested {
+			t.dataRequested = false
+			t.inData = strings.HasPrefix(line, "354")
+		}
+	}
+	fmt.Fprintf(t.out, "%s%s\n", prefix, line)
+}
+
+// redact hides credentials in a client line
+func (t *debugTranscript) redact(line string) string {
+	if t.redactNext {
+		t.redactNext = false
+		return "[redacted]"
+	}
+	fields := strings.Fields(line)
+	if len(fields) > 2 && strings.EqualFold(fields[0], "AUTH") {
+		return fields[0] + " " + fields[1] + " [redacted]"
+	}
+	return line
+}
@@ -0,0 +1,53 @@
+package gosmtpmail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestDebugTranscriptRedactsSplitWrites(t *testing.T) {
+	var out bytes.Buffer
+	transcript := &debugTranscript{out: &out}
+
+	// The AUTH line and the answer to a 334 challenge arrive in pieces
+	transcript.log("C: ", "AUTH PLAIN AGph")
+	transcript.log("C: ", "bmUAc2VjcmV0\r\n")
+	transcript.log("S: ", "334 VXNlcm5hbWU6\r\n")
+	transcript.log("C: ", "c2Vj")
+	transcript.log("C: ", "cmV0\r\n")
+	transcript.log("S: ", "235 2.7.0 ok\r\n")
+
+	want := "C: AUTH PLAIN [redacted]\nS: 334 VXNlcm5hbWU6\nC: [redacted]\nS: 235 2.7.0 ok\n"
+	if out.String() != want {
+		t.Errorf("transcript = %q, want %q", out.String(), want)
+	}
+}
+
+func TestDebugTranscriptOnTheWire(t *testing.T) {
+	server := newFakeServer(t)
+	var out bytes.Buffer
+	config := serverConfig(server)
+	config.DebugWriter = &out
+	useConfig(t, config)
+
+	if err := Send("Transcript", "confidential body text", "", "", []string{"jane@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	transcript := out.String()
+
+	if !strings.HasPrefix(transcript, "S: 220 fake.test ESMTP\n") {
+		t.Errorf("greeting not logged first:\n%s", transcript)
+	}
+	for _, want := range []string{"C: AUTH PLAIN [redacted]\n", "C: DATA\n", "S: 354 ", "C: [message data, ", "C: .\n", "S: 250 2.0.0 queued\n"} {
+		if !strings.Contains(transcript, want) {
+			t.Errorf("transcript is missing %q:\n%s", want, transcript)
+		}
+	}
+	for _, secret := range []string{"confidential body text", "Subject:", base64.StdEncoding.EncodeToString([]byte("\x00sender@example.com\x00secret"))} {
+		if strings.Contains(transcript, secret) {
+			t.Errorf("transcript contains %q:\n%s", secret, transcript)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package gosmtpmail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// CreateDigest bundles composed messages into a multipart/digest message
+func CreateDigest(subject string, to []string, messages [][]byte) ([]byte, error) {
+	if len(messages) == 0 {
+		return nil, errors.New("no messages to bundle")
+	}
+
+	// Validate sub-messages
+	content := make([]string, len(messages))
+	for i, message := range messages {
+		if _, err := mail.ReadMessage(bytes.NewReader(message)); err != nil {
+			return nil, fmt.Errorf("message %d is not a valid message: %w", i, err)
+		}
+		content[i] = string(message)
+	}
+	if err := validateLine(subject); err != nil {
+		return nil, err
+	}
+	toHeader, err := addressListHeader("To", to)
+	if err != nil {
+		return nil, err
+	}
+
+	// The boundary must not occur in any sub-message
+	var buf bytes.Buffer
+	writer, err := newMultipartWriter(&buf, "", content...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Headers
+	origin, err := originHeaders()
+	if err != nil {
+		return nil, err
+	}
+	headers := append([]string{
+		"MIME-Version: 1.0",
+		"From: " + fromAddress(),
+	}, origin...)
+	headers = append(headers,
+		toHeader,
+		encodedHeaderLine("Subject", encodeHeader(subject)),
+		"Content-Type: multipart/digest; boundary="+writer.Boundary(),
+	)
+	buf.Write([]byte(strings.Join(headers, "\r\n") + "\r\n\r\n"))
+
+	// Sub-message parts
+	for _, message := range messages {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", "message/rfc822")
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = part.Write(message); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,59 @@
+package gosmtpmail
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"testing"
+)
+
+func TestCreateDigest(t *testing.T) {
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com"})
+	first := composeMessage(t, "First", "one", "", "", []string{"jane@example.com"})
+	second := composeMessage(t, "Second", "two", "", "", []string{"jane@example.com"})
+
+	digest, err := CreateDigest("Daily digest", []string{"Jane Doe <jane@example.com>", "bob@example.com"}, [][]byte{first, second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := parseMessage(t, digest)
+	if got := msg.Header.Get("To"); got != `"Jane Doe" <jane@example.com>, bob@example.com` {
+		t.Errorf("To = %q", got)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/digest" {
+		t.Fatalf("Content-Type = %q, %v", msg.Header.Get("Content-Type"), err)
+	}
+
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	var subjects []string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if part.Header.Get("Content-Type") != "message/rfc822" {
+			t.Errorf("part Content-Type = %q, want message/rfc822", part.Header.Get("Content-Type"))
+		}
+		content, _ := io.ReadAll(part)
+		subjects = append(subjects, parseMessage(t, content).Header.Get("Subject"))
+	}
+	if len(subjects) != 2 || subjects[0] != "First" || subjects[1] != "Second" {
+		t.Errorf("digest parts have subjects %q, want [First Second]", subjects)
+	}
+}
+
+func TestCreateDigestRejectsHeaderInjection(t *testing.T) {
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com"})
+	message := composeMessage(t, "First", "one", "", "", []string{"jane@example.com"})
+
+	if _, err := CreateDigest("Digest", []string{"jane@example.com\r\nBcc: attacker@example.com"}, [][]byte{message}); err == nil {
+		t.Error("recipient with CRLF accepted")
+	}
+	if _, err := CreateDigest("Digest\r\nBcc: attacker@example.com", []string{"jane@example.com"}, [][]byte{message}); err == nil {
+		t.Error("subject with CRLF accepted")
+	}
+}
@@ -2,17 +2,30 @@ package gosmtpmail
 
 import (
 	"bytes"
-	"encoding/base64"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/mehmetdenizer/gohelpers"
+	"io"
+	"io/fs"
 	"mime"
 	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
 	"net/smtp"
 	"net/textproto"
+	"net/url"
 	"os"
-	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 )
 
 type EmailConfig struct {
@@ -24,166 +37,1327 @@ type EmailConfig struct {
 	ReplyTo              string
 	AttachmentPathPrefix string
 	BccAddressToSendCopy string
+	// TLSMode overrides the TLS mode otherwise derived from Port
+	TLSMode TLSMode
+	// RootCAs verifies the server certificate, e.g. for a private CA (default system roots)
+	RootCAs *x509.CertPool
+	// TLSSessionCacheSize is the number of TLS sessions kept for resumption (0 uses the default, negative disables)
+	TLSSessionCacheSize int
+	// OnTLSHandshake is called with the connection state after each TLS handshake,
+	// e.g. to observe DidResume
+	OnTLSHandshake func(state tls.ConnectionState)
+	// WrapPlainText soft-wraps the plain-text body at PlainTextWrapWidth columns
+	WrapPlainText bool
+	// PlainTextWrapWidth is the wrap width for WrapPlainText (default 78)
+	PlainTextWrapWidth int
+	// SkipMissingAttachments logs and omits a missing attachment file instead of
+	// failing the send; use WithSkippedAttachments to find out which were left out
+	SkipMissingAttachments bool
+	// BoundaryLength, when set, generates MIME boundaries of this many alphanumeric characters (16 to 70)
+	BoundaryLength int
+	// LocalName is the hostname sent in EHLO/HELO (default "localhost")
+	LocalName string
+	// IdempotencyStore reserves idempotency keys to skip duplicate sends (default in-memory)
+	IdempotencyStore IdempotencyStore
+	// DebugWriter receives the SMTP conversation with credentials redacted
+	DebugWriter io.Writer
+	// Middleware wraps every send, in order (the first one runs outermost)
+	Middleware []SendMiddleware
+	// PasswordFile, when set, is read by SetConfig and SetConfigE and takes precedence over Password
+	PasswordFile string
+	// OnError is called whenever a send ultimately fails; the error is still returned
+	OnError func(subject string, to []string, err error)
+	// AutoResponseSuppress emits X-Auto-Response-Suppress with these values (e.g. "OOF", "AutoReply")
+	AutoResponseSuppress []string
+	// MaxHeaderCount limits the number of top-level headers in a message (0 means unlimited)
+	MaxHeaderCount int
+	// RecipientRewrite rewrites every To and BCC address, in both the envelope and the headers
+	RecipientRewrite func(addr string) string
+	// DeriveSenderName uses the title-cased local part of EmailAddress when SenderName is empty
+	DeriveSenderName bool
+	// AttachSourceToBccCopy sends the BCC copy as a separate message with the composed email attached as .eml
+	AttachSourceToBccCopy bool
+	// KeepEmptySubject emits "Subject: " for an empty subject instead of omitting the header
+	KeepEmptySubject bool
+	// MailFromParams are ESMTP parameters appended to MAIL FROM when the server supports them
+	MailFromParams map[string]string
+	// StrictMailFromParams fails the send instead of dropping parameters the server doesn't support
+	StrictMailFromParams bool
+	// AllowAttachmentOnly allows sending an attachment without a text or HTML body
+	AllowAttachmentOnly bool
+	// Charset is the charset for body parts and encoded headers (default UTF-8)
+	Charset string
+	// DialNetwork is the network used to connect: "tcp" (default), "tcp4" or "tcp6"
+	DialNetwork string
+	// Dial, when set, replaces the built-in dialer, e.g. for tunnels or tests.
+	// With implicit TLS a plain connection it returns is wrapped in TLS.
+	Dial func(network, addr string) (net.Conn, error)
+	// StreamAttachments reads and encodes the attachment while writing the DATA
+	// stream instead of composing the whole message in memory first. Middleware
+	// receives a nil msg for streamed messages.
+	StreamAttachments bool
+	// DataBufferSize is the write buffer size for the DATA stream (default 32 KB)
+	DataBufferSize int
+	// DataIdleTimeout aborts the DATA phase when the server accepts no bytes
+	// for this long; the deadline resets on every write (0 disables)
+	DataIdleTimeout time.Duration
+	// StreamThresholdBytes streams messages whose attachment is larger than this
+	// many bytes, as if StreamAttachments were set (0 uses 5 MB, negative
+	// disables). Middleware receives a nil msg for these messages too.
+	StreamThresholdBytes int64
+	// QuotaStore is charged before each send with the tenant from WithTenant and refunded when it fails
+	QuotaStore QuotaStore
+	// StrictHTML rejects HTML bodies with scripts or tags loading remote resources
+	StrictHTML bool
+	// StripRemoteHTML makes StrictHTML remove the offending tags instead of rejecting the message
+	StripRemoteHTML bool
+	// MaxReplyTo caps the number of Reply-To addresses after deduplication (0 means unlimited)
+	MaxReplyTo int
+	// HTMLSanitizer, when set, repairs or sanitizes the HTML body before sending
+	HTMLSanitizer func(html string) (string, error)
+	// RejectMalformedHTML fails the send when HTMLSanitizer would change the HTML body
+	RejectMalformedHTML bool
+	// ReportAbuseURI emits an X-Report-Abuse header with this mailto: or https: URI
+	ReportAbuseURI string
+	// FormatFlowed sends the plain-text body as RFC 3676 format=flowed, soft-wrapped at 72 columns
+	FormatFlowed bool
+	// AuthMechanism is PLAIN (default), LOGIN, CRAM-MD5 or AUTO to pick the strongest the server offers
+	AuthMechanism string
+	// CircuitBreakerThreshold fast-fails sends with ErrCircuitOpen after this many consecutive transport failures (0 disables)
+	CircuitBreakerThreshold int
+	// CircuitBreakerCooldown is how long the breaker stays open before a trial send (default 30s)
+	CircuitBreakerCooldown time.Duration
+	// RequireVisibleRecipient fails sends with no To recipients instead of sending only to BccAddressToSendCopy
+	RequireVisibleRecipient bool
+	// EnforceLineLength fails the send when a line of the composed message exceeds 1000 octets including CRLF
+	EnforceLineLength bool
+	// RandomSource, when set, is read for MIME boundaries instead of crypto/rand
+	RandomSource io.Reader
+	// MultipartPreamble is the text before the first MIME boundary (default defaultMultipartPreamble)
+	MultipartPreamble string
+	// OmitMultipartPreamble sends the message without any preamble
+	OmitMultipartPreamble bool
+	// MultipartEpilogue is the text after the closing MIME boundary
+	MultipartEpilogue string
+	// InlinePolicy sends image attachments inline instead of as attachments (default InlineNone)
+	InlinePolicy InlinePolicy
+	// DisableRecipientNormalization sends to envelope recipients exactly as parsed, without lowercasing domains or deduplicating
+	DisableRecipientNormalization bool
 }
 
 var emailConfig EmailConfig
 
+// defaultMultipartPreamble is the preamble used when MultipartPreamble isn't set
+const defaultMultipartPreamble = "This is a multipart message in MIME format."
+
+// defaultStreamThresholdBytes is the attachment size above which messages are streamed
+const defaultStreamThresholdBytes = 5 << 20
+
+// sensitivityValues are the values RFC 2156 defines for the Sensitivity header
+var sensitivityValues = map[string]bool{
+	"Personal": true, "Private": true, "Company-Confidential": true,
+}
+
+// autoResponseSuppressValues are the values Exchange accepts in X-Auto-Response-Suppress
+var autoResponseSuppressValues = map[string]bool{
+	"None": true, "All": true, "DR": true, "NDR": true, "RN": true, "NRN": true, "OOF": true, "AutoReply": true,
+}
+
+// SetConfig sets the package configuration, reading PasswordFile if set. An
+// invalid configuration is logged and not applied; use SetConfigE to get the error.
 func SetConfig(config EmailConfig) {
+	if err := SetConfigE(config); err != nil {
+		gohelpers.LogError("Error setting email config:", err)
+	}
+}
+
+// SetConfigE is SetConfig that returns the error when config is invalid or
+// PasswordFile can't be read, leaving the previous configuration in place
+func SetConfigE(config EmailConfig) error {
+	if err := ValidateConfig(config); err != nil {
+		return err
+	}
+	if config.PasswordFile != "" {
+		password, err := os.ReadFile(config.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("reading password file: %w", err)
+		}
+		config.Password = strings.TrimRight(string(password), "\r\n")
+	}
 	emailConfig = config
+	return nil
+}
+
+// ValidateConfig checks config without applying it
+func ValidateConfig(config EmailConfig) error {
+	if !validAuthMechanism(config.AuthMechanism) {
+		return fmt.Errorf("unsupported auth mechanism: %q", config.AuthMechanism)
+	}
+	return nil
+}
+
+// EmailSender sends an email, reporting whether it was sent. New code should use Send.
+// A duplicate of an already sent message counts as sent.
+func EmailSender(subject, body, htmlBody, attachmentPath string, to []string, opts ...MessageOption) bool {
+	err := sendEmail(subject, body, htmlBody, attachmentPath, to, opts...)
+	return err == nil || errors.Is(err, ErrDuplicateSend)
+}
+
+// EmailSenderE is EmailSender that also returns the error, as a step towards
+// migrating EmailSender calls to Send. A duplicate reports true with ErrDuplicateSend.
+func EmailSenderE(subject, body, htmlBody, attachmentPath string, to []string, opts ...MessageOption) (bool, error) {
+	err := sendEmail(subject, body, htmlBody, attachmentPath, to, opts...)
+	return err == nil || errors.Is(err, ErrDuplicateSend), err
+}
+
+// Send sends an email. It returns ErrDuplicateSend without sending when a
+// message with the same idempotency key was already sent.
+func Send(subject, body, htmlBody, attachmentPath string, to []string, opts ...MessageOption) error {
+	return sendEmail(subject, body, htmlBody, attachmentPath, to, opts...)
+}
+
+// SendTestEmail sends a minimal test message to verify the configuration
+func SendTestEmail(to string) error {
+	subject := "gosmtpmail test email"
+	body := fmt.Sprintf("This is a test email sent by gosmtpmail to verify the SMTP configuration of %s via %s:%s.\r\nNo action is required.",
+		emailConfig.EmailAddress,
+		emailConfig.Host,
+		emailConfig.Port)
+	return sendEmail(subject, body, "", "", []string{to})
+}
+
+// SendEnvelope sends body verbatim to the envelope recipients, without
+// adding any headers. body must be a complete message with CRLF line endings.
+// Idempotency keys, quotas and RecipientRewrite apply as for Send, the latter
+// to the envelope only; options that change the message content have no effect.
+func SendEnvelope(from string, to []string, body []byte, opts ...MessageOption) error {
+	options := newMessageOptions(opts)
+	err := guardedSend(options, func() error {
+		return deliverEnvelope(from, to, body, options)
+	})
+
+	// Report the final failure; a skipped duplicate isn't one
+	if err != nil && !errors.Is(err, ErrDuplicateSend) && emailConfig.OnError != nil {
+		emailConfig.OnError(envelopeSubject(body), to, err)
+	}
+	return err
+}
+
+// deliverEnvelope sends body verbatim, logging and returning any error
+func deliverEnvelope(from string, to []string, body []byte, options messageOptions) error {
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return fmt.Errorf("invalid sender %q: %w", from, err)
+	}
+	to, err = rewriteRecipients(to)
+	if err != nil {
+		gohelpers.LogError("Error rewriting recipient:", err)
+		return err
+	}
+	recipients, err := envelopeAddresses(to)
+	if err != nil {
+		return err
+	}
+	if len(recipients) == 0 {
+		return errors.New("no recipients provided")
+	}
+
+	auth := emailAuth()
+	send := func(from string, to []string, msg []byte) error {
+		return sendMail(emailConfig.Host+":"+emailConfig.Port, auth, from, to, rawMessage(msg), nil, options)
+	}
+	err = chainMiddleware(send, emailConfig.Middleware)(sender.Address, recipients, body)
+	if err != nil {
+		gohelpers.LogError("Error sending email:", err)
+		return err
+	}
+	return nil
+}
+
+// envelopeSubject returns the Subject header of a message passed to
+// SendEnvelope, or "" when it can't be parsed
+func envelopeSubject(body []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+	return msg.Header.Get("Subject")
+}
+
+// sendEmail sends an email after applying the message options
+func sendEmail(subject, body, htmlBody, attachmentPath string, to []string, opts ...MessageOption) error {
+	options := newMessageOptions(opts)
+	err := guardedSend(options, func() error {
+		return deliverEmail(subject, body, htmlBody, attachmentPath, to, options)
+	})
+
+	// Report the final failure; a skipped duplicate isn't one
+	if err != nil && !errors.Is(err, ErrDuplicateSend) && emailConfig.OnError != nil {
+		emailConfig.OnError(subject, to, err)
+	}
+	return err
 }
 
-// EmailSender sends an email
-func EmailSender(subject, body, htmlBody, attachmentPath string, to []string) bool {
+// guardedSend runs deliver at most once per idempotency key and within the
+// tenant's quota, releasing the key when delivery fails
+func guardedSend(options messageOptions, deliver func() error) error {
+	if options.idempotencyKey == "" {
+		return quotaSend(options.tenant, deliver)
+	}
+
+	// Skip messages that were already sent
+	store := idempotencyStore()
+	if err := store.Reserve(options.idempotencyKey); err != nil {
+		if errors.Is(err, ErrDuplicateSend) {
+			gohelpers.LogInfo("Skipping duplicate email with idempotency key: " + options.idempotencyKey)
+		}
+		return err
+	}
+	if err := quotaSend(options.tenant, deliver); err != nil {
+		store.Release(options.idempotencyKey)
+		return err
+	}
+	store.Complete(options.idempotencyKey)
+	return nil
+}
+
+// quotaSend runs deliver when the tenant is within its quota, refunding the
+// send when delivery fails
+func quotaSend(tenant string, deliver func() error) error {
+	if emailConfig.QuotaStore == nil {
+		return deliver()
+	}
+	allowed, err := emailConfig.QuotaStore.Allow(tenant)
+	if err != nil {
+		gohelpers.LogError("Error checking quota:", err)
+		return err
+	}
+	if !allowed {
+		gohelpers.LogError("Error sending email:", ErrQuotaExceeded)
+		return ErrQuotaExceeded
+	}
+	if err = deliver(); err != nil {
+		emailConfig.QuotaStore.Refund(tenant)
+	}
+	return err
+}
+
+// deliverEmail composes and sends an email, logging and returning any error
+func deliverEmail(subject, body, htmlBody, attachmentPath string, to []string, options messageOptions) error {
 	// Define Auth
 	auth := emailAuth()
 
-	// Append BCC address if it's not empty
-	recipients := to
-	if emailConfig.BccAddressToSendCopy != "" {
-		recipients = append(recipients, emailConfig.BccAddressToSendCopy)
+	// Rewrite recipients
+	bcc := emailConfig.BccAddressToSendCopy
+	if emailConfig.RecipientRewrite != nil {
+		var err error
+		if to, err = rewriteRecipients(to); err != nil {
+			gohelpers.LogError("Error rewriting recipient:", err)
+			return err
+		}
+		if bcc != "" {
+			var err error
+			if bcc, err = rewriteRecipient(bcc); err != nil {
+				gohelpers.LogError("Error rewriting recipient:", err)
+				return err
+			}
+		}
+	}
+
+	// Envelope recipients are the bare addresses
+	recipients, err := envelopeAddresses(to)
+	if err != nil {
+		gohelpers.LogError("Error parsing recipients:", err)
+		return err
+	}
+	if len(recipients) == 0 && emailConfig.RequireVisibleRecipient {
+		gohelpers.LogError("Error sending email:", ErrNoVisibleRecipients)
+		return ErrNoVisibleRecipients
 	}
 
-	// Create message
-	message, e := createEmailMessage(subject, body, htmlBody, attachmentPath, to)
+	// Add the BCC address if it's not sent as a debug copy, normalizing and
+	// deduplicating it together with the visible recipients
+	debugCopy := bcc != "" && emailConfig.AttachSourceToBccCopy
+	if bcc != "" {
+		envelope := []string{bcc}
+		if !debugCopy {
+			envelope = append(append([]string{}, to...), bcc)
+		}
+		addresses, err := envelopeAddresses(envelope)
+		if err != nil {
+			gohelpers.LogError("Error parsing recipients:", err)
+			return err
+		}
+		if debugCopy {
+			bcc = addresses[0]
+		} else {
+			recipients = addresses
+		}
+	}
+
+	// Create message; a streamed message is only composed up to the attachment
+	var message []byte
+	var streamed messageSource
+	var e error
+	stream := shouldStream(attachmentPath)
+	if stream {
+		streamed, e = composeEmailMessage(subject, body, htmlBody, attachmentPath, to, options)
+	} else {
+		message, e = createEmailMessage(subject, body, htmlBody, attachmentPath, to, options)
+	}
 	if e != nil {
 		gohelpers.LogError("Error creating message:", e)
-		return false
+		return e
 	}
 
 	// Send mail
-	err := smtp.SendMail(
-		emailConfig.Host+":"+emailConfig.Port,
-		auth,
-		emailConfig.EmailAddress,
-		recipients,
-		message)
+	sevenBitMessage := func() (messageSource, error) {
+		sevenBitOptions := options
+		sevenBitOptions.sevenBit = true
+		if stream {
+			return composeEmailMessage(subject, body, htmlBody, attachmentPath, to, sevenBitOptions)
+		}
+		sevenBit, err := createEmailMessage(subject, body, htmlBody, attachmentPath, to, sevenBitOptions)
+		return rawMessage(sevenBit), err
+	}
+	send := func(from string, to []string, msg []byte) error {
+		source := streamed
+		if msg != nil {
+			source = rawMessage(msg)
+		}
+		return sendMail(emailConfig.Host+":"+emailConfig.Port, auth, from, to, source, sevenBitMessage, options)
+	}
+	err = chainMiddleware(send, emailConfig.Middleware)(emailConfig.EmailAddress, recipients, message)
 	if err != nil {
 		gohelpers.LogError("Error sending email:", err)
+		return err
+	}
+
+	// Send the debug copy with the composed message attached
+	if debugCopy {
+		if message == nil {
+			if message, err = createEmailMessage(subject, body, htmlBody, attachmentPath, to, options); err != nil {
+				gohelpers.LogError("Error creating debug copy:", err)
+				return nil
+			}
+		}
+		debugMessage, err := createDebugCopyMessage(subject, bcc, message)
+		if err != nil {
+			gohelpers.LogError("Error creating debug copy:", err)
+			return nil
+		}
+		// Without 8BITMIME the debug copy attaches the 7-bit version of the message
+		sevenBitDebugMessage := func() (messageSource, error) {
+			sevenBit, err := sevenBitMessage()
+			if err != nil {
+				return nil, err
+			}
+			var original bytes.Buffer
+			if err = sevenBit.writeTo(&original); err != nil {
+				return nil, err
+			}
+			debugMessage, err := createDebugCopyMessage(subject, bcc, original.Bytes())
+			return rawMessage(debugMessage), err
+		}
+		sendDebugCopy := func(from string, to []string, msg []byte) error {
+			return sendMail(emailConfig.Host+":"+emailConfig.Port, auth, from, to, rawMessage(msg), sevenBitDebugMessage, options)
+		}
+		err = chainMiddleware(sendDebugCopy, emailConfig.Middleware)(emailConfig.EmailAddress, []string{bcc}, debugMessage)
+		if err != nil {
+			gohelpers.LogError("Error sending debug copy:", err)
+		}
+	}
+	return nil
+}
+
+// shouldStream reports whether the message with this attachment is streamed
+// to DATA instead of being composed in memory
+func shouldStream(attachmentPath string) bool {
+	if emailConfig.StreamAttachments {
+		return true
+	}
+	threshold := emailConfig.StreamThresholdBytes
+	if threshold == 0 {
+		threshold = defaultStreamThresholdBytes
+	}
+	if threshold < 0 || attachmentPath == "" {
+		return false
+	}
+	info, err := os.Stat(attachmentPath)
+	if err != nil || info.Size() <= threshold {
 		return false
 	}
+	// Middleware written for in-memory messages may not expect a nil msg
+	if len(emailConfig.Middleware) > 0 {
+		gohelpers.LogWarning(fmt.Sprintf("Streaming message with a %d byte attachment; middleware receives a nil msg (see StreamThresholdBytes)", info.Size()))
+	}
 	return true
 }
 
+// createDebugCopyMessage creates a message for the debug recipient with the
+// composed original attached as message/rfc822
+func createDebugCopyMessage(subject, to string, original []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := newMultipartWriter(&buf, "", string(original))
+	if err != nil {
+		return nil, err
+	}
+
+	origin, err := originHeaders()
+	if err != nil {
+		return nil, err
+	}
+	headers := append([]string{
+		"MIME-Version: 1.0",
+		"From: " + fromAddress(),
+	}, origin...)
+	headers = append(headers,
+		"To: "+to,
+		encodedHeaderLine("Subject", encodeHeader("Debug copy: "+subject)),
+		"Content-Type: multipart/mixed; boundary="+writer.Boundary(),
+	)
+	buf.Write([]byte(strings.Join(headers, "\r\n") + "\r\n\r\n"))
+
+	body := "The composed message is attached as message.eml."
+	if err := writeTextPart(writer, "text/plain; charset=UTF-8", body, false); err != nil {
+		return nil, err
+	}
+
+	originalHeader := textproto.MIMEHeader{}
+	originalHeader.Set("Content-Type", "message/rfc822")
+	originalHeader.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "message.eml"}))
+	if !isASCII(string(original)) {
+		// message/rfc822 can't be encoded, so 8-bit content is declared instead
+		originalHeader.Set("Content-Transfer-Encoding", "8bit")
+	}
+	originalPart, err := writer.CreatePart(originalHeader)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = originalPart.Write(original); err != nil {
+		return nil, err
+	}
+
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// rewriteRecipients applies RecipientRewrite, when set, to every address in to
+func rewriteRecipients(to []string) ([]string, error) {
+	if emailConfig.RecipientRewrite == nil {
+		return to, nil
+	}
+	rewritten := make([]string, len(to))
+	for i, addr := range to {
+		var err error
+		if rewritten[i], err = rewriteRecipient(addr); err != nil {
+			return nil, err
+		}
+	}
+	return rewritten, nil
+}
+
+// rewriteRecipient applies RecipientRewrite to addr and validates the result
+func rewriteRecipient(addr string) (string, error) {
+	rewritten := emailConfig.RecipientRewrite(addr)
+	if _, err := mail.ParseAddress(rewritten); err != nil {
+		return "", fmt.Errorf("invalid rewritten recipient %q: %w", rewritten, err)
+	}
+	return rewritten, nil
+}
+
 // emailAuth returns smtp.Auth type
 func emailAuth() smtp.Auth {
-	return smtp.PlainAuth("", emailConfig.EmailAddress, emailConfig.Password, emailConfig.Host)
+	return newAuth(emailConfig.AuthMechanism, emailConfig.EmailAddress, emailConfig.Password, emailConfig.Host)
 }
 
-// encodeHeader encodes header in base64
+// encodeHeader encodes header as RFC 2047 encoded words when it isn't plain
+// ASCII, using Q-encoding when it is no longer than B-encoding. Each word is
+// at most 75 characters and consecutive words are folded onto new lines.
 func encodeHeader(header string) string {
-	return fmt.Sprintf("=?UTF-8?B?%s?=", base64.StdEncoding.EncodeToString([]byte(header)))
+	encoded := mime.QEncoding.Encode("UTF-8", header)
+	if b := mime.BEncoding.Encode("UTF-8", header); len(b) < len(encoded) {
+		encoded = b
+	}
+	if encoded == header {
+		return header
+	}
+	return strings.ReplaceAll(encoded, "?= =?", "?=\r\n =?")
+}
+
+// maxEncodedLineLength is the RFC 2047 limit for lines containing encoded words
+const maxEncodedLineLength = 76
+
+// encodedHeaderLine returns a folded header with an encodeHeader value,
+// folding before the first encoded word when it doesn't fit on the first line
+func encodedHeaderLine(name, encoded string) string {
+	first, _, _ := strings.Cut(encoded, "\r\n")
+	if strings.HasPrefix(first, "=?") && len(name)+2+len(first) > maxEncodedLineLength {
+		return name + ":\r\n " + encoded
+	}
+	return foldHeader(name + ": " + encoded)
+}
+
+// fromAddress returns the From address with the sender's display name
+// originHeaders returns the Date and Message-ID headers every message carries
+// (RFC 5322 3.6)
+func originHeaders() ([]string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("generating Message-ID: %w", err)
+	}
+	domain := "localhost"
+	if at := strings.LastIndexByte(emailConfig.EmailAddress, '@'); at >= 0 && at < len(emailConfig.EmailAddress)-1 {
+		domain = emailConfig.EmailAddress[at+1:]
+	}
+	return []string{
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"Message-ID: <" + hex.EncodeToString(id) + "@" + domain + ">",
+	}, nil
+}
+
+func fromAddress() string {
+	name := emailConfig.SenderName
+	if name == "" && emailConfig.DeriveSenderName {
+		name = senderNameFromAddress(emailConfig.EmailAddress)
+	}
+	if name == "" {
+		return "<" + emailConfig.EmailAddress + ">"
+	}
+	return fmt.Sprintf("%s <%s>", formatPhrase(name), emailConfig.EmailAddress)
+}
+
+// replyToHeader parses the comma-separated ReplyTo addresses and returns a
+// deduplicated, capped and folded Reply-To header
+func replyToHeader() (string, error) {
+	addresses, err := mail.ParseAddressList(emailConfig.ReplyTo)
+	if err != nil {
+		return "", fmt.Errorf("invalid Reply-To: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	var formatted []string
+	for _, address := range addresses {
+		key := strings.ToLower(address.Address)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if emailConfig.MaxReplyTo > 0 && len(formatted) == emailConfig.MaxReplyTo {
+			gohelpers.LogWarning("Dropping Reply-To addresses over the limit of " + strconv.Itoa(emailConfig.MaxReplyTo))
+			break
+		}
+		formatted = append(formatted, formatAddress(address))
+	}
+	return "Reply-To: " + strings.Join(formatted, ",\r\n "), nil
+}
+
+// envelopeAddresses parses recipients, which may have display names, into
+// bare addresses. Unless DisableRecipientNormalization is set, domains are
+// lowercased and addresses differing only in case are sent to once.
+func envelopeAddresses(recipients []string) ([]string, error) {
+	addresses := make([]string, 0, len(recipients))
+	seen := make(map[string]bool, len(recipients))
+	for _, recipient := range recipients {
+		address, err := mail.ParseAddress(strings.TrimSpace(recipient))
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient %q: %w", recipient, err)
+		}
+		if emailConfig.DisableRecipientNormalization {
+			addresses = append(addresses, address.Address)
+			continue
+		}
+		normalized := normalizeAddress(address.Address)
+		if key := strings.ToLower(normalized); !seen[key] {
+			seen[key] = true
+			addresses = append(addresses, normalized)
+		}
+	}
+	return addresses, nil
+}
+
+// normalizeAddress lowercases the domain of address, leaving the local part as is
+func normalizeAddress(address string) string {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return address
+	}
+	return address[:at+1] + strings.ToLower(address[at+1:])
+}
+
+// addressListHeader parses recipients and returns them as a folded header
+// with display names quoted or encoded as needed
+func addressListHeader(name string, recipients []string) (string, error) {
+	formatted := make([]string, len(recipients))
+	for i, recipient := range recipients {
+		address, err := mail.ParseAddress(recipient)
+		if err != nil {
+			return "", fmt.Errorf("invalid recipient %q: %w", recipient, err)
+		}
+		formatted[i] = formatAddress(address)
+	}
+	return name + ": " + strings.Join(formatted, ",\r\n "), nil
+}
+
+// isMailtoOrWebURI reports whether uri is a mailto:, http: or https: URI that
+// can be enclosed in angle brackets in a header
+func isMailtoOrWebURI(uri string) bool {
+	parsed, err := url.Parse(uri)
+	if err != nil || strings.ContainsAny(uri, "<> \r\n") {
+		return false
+	}
+	return parsed.Scheme == "mailto" || parsed.Scheme == "https" || parsed.Scheme == "http"
+}
+
+// listUnsubscribeHeader validates the unsubscribe URIs and returns a folded List-Unsubscribe header
+func listUnsubscribeHeader(uris []string) (string, error) {
+	bracketed := make([]string, len(uris))
+	for i, uri := range uris {
+		if !isMailtoOrWebURI(uri) {
+			return "", errors.New("invalid List-Unsubscribe URI: " + uri)
+		}
+		bracketed[i] = "<" + uri + ">"
+	}
+	return foldHeader("List-Unsubscribe: " + strings.Join(bracketed, ", ")), nil
+}
+
+// keywordsHeader returns a folded Keywords header joining the keywords with
+// commas, quoting or encoding each one as a phrase
+func keywordsHeader(keywords []string, charset string) (string, error) {
+	phrases := make([]string, 0, len(keywords))
+	for _, keyword := range keywords {
+		keyword = strings.TrimSpace(keyword)
+		if keyword == "" {
+			continue
+		}
+		if strings.ContainsAny(keyword, "\r\n") {
+			return "", errors.New("invalid keyword: " + keyword)
+		}
+		phrase := keyword
+		if !isASCII(keyword) {
+			encoded, err := encodeHeaderCharset(keyword, charset)
+			if err != nil {
+				return "", err
+			}
+			// Refold the encoded words together with the other keywords
+			phrase = strings.ReplaceAll(encoded, "\r\n ", " ")
+		} else if strings.ContainsAny(keyword, "()<>[]:;@\\,.\"") {
+			phrase = strconv.Quote(keyword)
+		}
+		phrases = append(phrases, phrase)
+	}
+	if len(phrases) == 0 {
+		return "", nil
+	}
+	return foldHeader("Keywords: " + strings.Join(phrases, ", ")), nil
+}
+
+// listIDHeader validates an RFC 2919 list identifier and returns the List-ID header
+func listIDHeader(description, id string) (string, error) {
+	labels := strings.Split(id, ".")
+	if len(labels) < 2 || len(id) > 255 {
+		return "", errors.New("invalid List-ID: " + id)
+	}
+	for _, label := range labels {
+		if !isAtom(label) || strings.ContainsAny(label, "@") {
+			return "", errors.New("invalid List-ID: " + id)
+		}
+	}
+	if description == "" {
+		return "List-ID: <" + id + ">", nil
+	}
+	return foldHeader("List-ID: " + formatPhrase(description) + " <" + id + ">"), nil
+}
+
+// formatPhrase formats a display phrase, quoting ASCII text with specials and
+// encoding non-ASCII text
+func formatPhrase(phrase string) string {
+	if !isASCII(phrase) || strings.ContainsAny(phrase, "\r\n") {
+		return encodeHeader(phrase)
+	}
+	if strings.ContainsAny(phrase, "()<>[]:;@\\,.\"") {
+		return strconv.Quote(phrase)
+	}
+	return phrase
+}
+
+// formatAddress formats an address, bare when it has no display name,
+// quoting an ASCII display name as needed and encoding a non-ASCII one
+func formatAddress(address *mail.Address) string {
+	if address.Name == "" {
+		return address.Address
+	}
+	if isASCII(address.Name) {
+		return address.String()
+	}
+	return encodeHeader(address.Name) + " <" + address.Address + ">"
+}
+
+// senderNameFromAddress title-cases the local part of address, e.g. "support@x" becomes "Support"
+func senderNameFromAddress(address string) string {
+	localPart, _, _ := strings.Cut(address, "@")
+	words := strings.FieldsFunc(localPart, func(r rune) bool {
+		return r == '.' || r == '_' || r == '-' || r == '+'
+	})
+	for i, word := range words {
+		runes := []rune(word)
+		runes[0] = unicode.ToUpper(runes[0])
+		words[i] = string(runes)
+	}
+	return strings.Join(words, " ")
+}
+
+// foldHeader folds a header line at whitespace so lines stay within 78 characters
+func foldHeader(line string) string {
+	// Already folded, e.g. by encodeHeader
+	if strings.Contains(line, "\r\n") {
+		return line
+	}
+
+	var folded strings.Builder
+	lineLength := 0
+	for i, word := range strings.Split(line, " ") {
+		if i > 0 {
+			if lineLength+1+len(word) > defaultWrapWidth {
+				folded.WriteString("\r\n")
+				lineLength = 0
+			}
+			folded.WriteByte(' ')
+			lineLength++
+		}
+		folded.WriteString(word)
+		lineLength += len(word)
+	}
+	return folded.String()
 }
 
 // createEmailMessage creates an email message with an attachment
-func createEmailMessage(subject, body, htmlBody, attachmentPath string, to []string) ([]byte, error) {
+func createEmailMessage(subject, body, htmlBody, attachmentPath string, to []string, options messageOptions) ([]byte, error) {
+	message, err := composeEmailMessage(subject, body, htmlBody, attachmentPath, to, options)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = message.writeTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// composeEmailMessage composes the headers and body parts of an email
+// message. The attachment is only read when the message is written out.
+func composeEmailMessage(subject, body, htmlBody, attachmentPath string, to []string, options messageOptions) (*emailMessage, error) {
 	// Check if attachment path starts with "storage/" ("storage/" is an example)
 	prefix := emailConfig.AttachmentPathPrefix + "/"
 	if attachmentPath != "" && !strings.HasPrefix(attachmentPath, prefix) {
-		return nil, errors.New("attachment path must start with: " + prefix)
+		return nil, &AttachmentPathError{Path: attachmentPath, Prefix: prefix}
 	}
 
-	var buf bytes.Buffer
-	writer := multipart.NewWriter(&buf)
-
-	// Headers
-	boundary := writer.Boundary()
-	headers := fmt.Sprintf("MIME-Version: 1.0\r\nFrom: %s <%s>\r\nTo: %s\r\nSubject: %s\r\nReply-To: %s\r\nContent-Type: multipart/mixed; boundary=%s\r\n\r\n",
-		encodeHeader(emailConfig.SenderName),
-		emailConfig.EmailAddress,
-		strings.Join(to, ", "),
-		encodeHeader(subject),
-		emailConfig.ReplyTo,
-		boundary)
-	buf.Write([]byte(headers))
+	// Validate the custom body Content-Type
+	var bodyType string
+	if options.bodyType != "" {
+		if htmlBody != "" {
+			return nil, errors.New("a custom body Content-Type can't be combined with an HTML body")
+		}
+		mediaType, params, err := mime.ParseMediaType(options.bodyType)
+		if err != nil || !strings.Contains(mediaType, "/") || strings.HasPrefix(mediaType, "multipart/") {
+			return nil, errors.New("invalid body Content-Type: " + options.bodyType)
+		}
+		bodyType = mime.FormatMediaType(mediaType, params)
+	}
 
-	// Body part
-	if body != "" && htmlBody != "" {
-		// If both text and HTML are provided
-		altWriter := multipart.NewWriter(&buf)
-		altBoundary := altWriter.Boundary()
-		buf.Write([]byte(fmt.Sprintf("--%s\r\nContent-Type: multipart/alternative; boundary=%s\r\n\r\n", boundary, altBoundary)))
+	// Wrap plain text if enabled
+	textType := "text/plain"
+	if bodyType == "" && emailConfig.FormatFlowed {
+		body = flowText(body)
+	} else if bodyType == "" && emailConfig.WrapPlainText {
+		body = wrapText(body, emailConfig.PlainTextWrapWidth)
+	}
 
-		// Plain text part
-		textHeader := textproto.MIMEHeader{}
-		textHeader.Set("Content-Type", "text/plain; charset=UTF-8")
-		textPart, err := altWriter.CreatePart(textHeader)
+	// Sanitize HTML
+	if emailConfig.HTMLSanitizer != nil && htmlBody != "" {
+		sanitized, err := emailConfig.HTMLSanitizer(htmlBody)
 		if err != nil {
+			return nil, fmt.Errorf("sanitizing HTML body: %w", err)
+		}
+		if sanitized != htmlBody && emailConfig.RejectMalformedHTML {
+			return nil, errors.New("HTML body is malformed or contains unsafe content")
+		}
+		htmlBody = sanitized
+	}
+
+	// Enforce the no-remote-content policy
+	if emailConfig.StrictHTML && htmlBody != "" {
+		var err error
+		if htmlBody, err = enforceStrictHTML(htmlBody); err != nil {
 			return nil, err
 		}
-		_, err = textPart.Write([]byte(body))
-		if err != nil {
+	}
+
+	// Use CRLF line endings throughout, so the message ends with a single CRLF
+	// after the closing boundary and body hashes are stable
+	body = normalizeLineEndings(body)
+	htmlBody = normalizeLineEndings(htmlBody)
+
+	// Encode subject and body in the message charset
+	charset := messageCharset(options)
+	encodedSubject, err := encodeHeaderCharset(subject, charset)
+	if err != nil {
+		return nil, err
+	}
+	// A custom Content-Type declares its own charset, if any
+	if bodyType == "" {
+		if body, err = transcode(body, charset); err != nil {
+			return nil, err
+		}
+	}
+	if htmlBody, err = transcode(htmlBody, charset); err != nil {
+		return nil, err
+	}
+	textType += "; charset=" + charset
+	if emailConfig.FormatFlowed {
+		textType += "; format=flowed"
+	}
+
+	// Check the attachment; a missing one may be skipped
+	if attachmentPath != "" {
+		_, err = os.Stat(attachmentPath)
+		if errors.Is(err, fs.ErrNotExist) && emailConfig.SkipMissingAttachments {
+			gohelpers.LogWarning("Skipping missing attachment: " + attachmentPath)
+			// The message may be composed again for the 7-bit fallback
+			if options.skipped != nil && !slices.Contains(*options.skipped, attachmentPath) {
+				*options.skipped = append(*options.skipped, attachmentPath)
+			}
+			attachmentPath = ""
+			if body == "" && htmlBody == "" {
+				return nil, errors.New("attachment-only message is missing its attachment")
+			}
+		} else if err != nil {
 			return nil, err
 		}
+	}
+	// Inline images referenced by the HTML body are grouped with it in
+	// multipart/related (RFC 2387)
+	inline := attachmentPath != "" && inlineAttachment(attachmentPath, htmlBody)
+	rootType := "multipart/mixed"
+	if inline && htmlBody != "" && bodyType == "" {
+		rootType = `multipart/related; type="text/html"`
+		if body != "" {
+			rootType = `multipart/related; type="multipart/alternative"`
+		}
+	}
 
-		// HTML part
-		htmlHeader := textproto.MIMEHeader{}
-		htmlHeader.Set("Content-Type", "text/html; charset=UTF-8")
-		htmlPart, err := altWriter.CreatePart(htmlHeader)
+	// A custom body type without an attachment is sent as a single part
+	singlePart := bodyType != "" && attachmentPath == ""
+
+	message := &emailMessage{}
+	writer, err := newMultipartWriter(&message.head, "", body, htmlBody)
+	if err != nil {
+		return nil, err
+	}
+	if !singlePart {
+		message.boundary = writer.Boundary()
+	}
+
+	// Headers
+	boundary := writer.Boundary()
+	for _, line := range options.prependedHeaders {
+		if err := validateHeaderLine(line); err != nil {
+			return nil, err
+		}
+	}
+	headers := append([]string{}, options.prependedHeaders...)
+	origin, err := originHeaders()
+	if err != nil {
+		return nil, err
+	}
+	headers = append(headers,
+		"MIME-Version: 1.0",
+		"From: "+fromAddress(),
+	)
+	headers = append(headers, origin...)
+	if len(to) > 0 {
+		toHeader, err := addressListHeader("To", to)
 		if err != nil {
 			return nil, err
 		}
-		_, err = htmlPart.Write([]byte(htmlBody))
+		headers = append(headers, toHeader)
+	}
+	if subject != "" {
+		headers = append(headers, encodedHeaderLine("Subject", encodedSubject))
+	} else if emailConfig.KeepEmptySubject {
+		headers = append(headers, "Subject: ")
+	}
+	if emailConfig.ReplyTo != "" {
+		replyTo, err := replyToHeader()
 		if err != nil {
 			return nil, err
 		}
-
-		err = altWriter.Close()
+		headers = append(headers, replyTo)
+	}
+	if options.comments != "" {
+		comments, err := encodeHeaderCharset(options.comments, charset)
 		if err != nil {
 			return nil, err
 		}
-	} else if body != "" {
-		// If only text is provided
-		textHeader := textproto.MIMEHeader{}
-		textHeader.Set("Content-Type", "text/plain; charset=UTF-8")
-		textPart, err := writer.CreatePart(textHeader)
+		headers = append(headers, encodedHeaderLine("Comments", comments))
+	}
+	if len(options.keywords) > 0 {
+		keywords, err := keywordsHeader(options.keywords, charset)
 		if err != nil {
 			return nil, err
 		}
-		_, err = textPart.Write([]byte(body))
+		if keywords != "" {
+			headers = append(headers, keywords)
+		}
+	}
+	if options.sensitivity != "" {
+		if !sensitivityValues[options.sensitivity] {
+			return nil, errors.New("invalid Sensitivity value: " + options.sensitivity)
+		}
+		headers = append(headers, "Sensitivity: "+options.sensitivity)
+	}
+	if options.archivedAt != "" {
+		archivedAt, err := url.Parse(options.archivedAt)
+		if err != nil || !archivedAt.IsAbs() || strings.ContainsAny(options.archivedAt, "<> \r\n") {
+			return nil, errors.New("invalid Archived-At URL: " + options.archivedAt)
+		}
+		headers = append(headers, "Archived-At: <"+archivedAt.String()+">")
+	}
+	if len(options.unsubscribe) > 0 {
+		unsubscribe, err := listUnsubscribeHeader(options.unsubscribe)
 		if err != nil {
 			return nil, err
 		}
-	} else if htmlBody != "" {
-		// If only HTML is provided
-		htmlHeader := textproto.MIMEHeader{}
-		htmlHeader.Set("Content-Type", "text/html; charset=UTF-8")
-		htmlPart, err := writer.CreatePart(htmlHeader)
+		headers = append(headers, unsubscribe)
+	}
+	if options.listID != "" {
+		listID, err := listIDHeader(options.listName, options.listID)
 		if err != nil {
 			return nil, err
 		}
-		_, err = htmlPart.Write([]byte(htmlBody))
+		headers = append(headers, listID)
+	}
+	if options.class == ClassBulk {
+		if len(options.unsubscribe) == 0 {
+			return nil, errors.New("bulk messages require List-Unsubscribe")
+		}
+		headers = append(headers, "Precedence: bulk", "Auto-Submitted: auto-generated")
+	}
+	if emailConfig.ReportAbuseURI != "" {
+		if !isMailtoOrWebURI(emailConfig.ReportAbuseURI) {
+			return nil, errors.New("invalid X-Report-Abuse URI: " + emailConfig.ReportAbuseURI)
+		}
+		headers = append(headers, "X-Report-Abuse: <"+emailConfig.ReportAbuseURI+">")
+	}
+	if len(emailConfig.AutoResponseSuppress) > 0 {
+		for _, value := range emailConfig.AutoResponseSuppress {
+			if !autoResponseSuppressValues[value] {
+				return nil, errors.New("invalid X-Auto-Response-Suppress value: " + value)
+			}
+		}
+		headers = append(headers, "X-Auto-Response-Suppress: "+strings.Join(emailConfig.AutoResponseSuppress, ", "))
+	}
+	for _, header := range options.extraHeaders {
+		line, err := customHeader(header[0], header[1], charset)
 		if err != nil {
 			return nil, err
 		}
+		headers = append(headers, line)
+	}
+	// A multipart must be declared 8bit when a part in it is (RFC 2045 6.4)
+	containerEncoding := "7bit"
+	if !options.sevenBit && (!isASCII(body) || !isASCII(htmlBody)) {
+		containerEncoding = "8bit"
+	}
+	if singlePart {
+		headers = append(headers, "Content-Type: "+bodyType, "Content-Transfer-Encoding: "+textEncoding(body, options.sevenBit))
 	} else {
-		return nil, errors.New("neither body nor htmlBody provided")
+		headers = append(headers, "Content-Type: "+rootType+"; boundary="+boundary, "Content-Transfer-Encoding: "+containerEncoding)
 	}
+	if emailConfig.MaxHeaderCount > 0 && len(headers) > emailConfig.MaxHeaderCount {
+		return nil, fmt.Errorf("message has %d headers, more than the limit of %d", len(headers), emailConfig.MaxHeaderCount)
+	}
+	message.head.Write([]byte(strings.Join(headers, "\r\n") + "\r\n\r\n"))
 
-	// Attachment part
-	if attachmentPath != "" {
-		attachment, err := os.ReadFile(attachmentPath)
-		if err != nil {
+	if singlePart {
+		if err := writeText(&message.head, body, options.sevenBit); err != nil {
 			return nil, err
 		}
-		attachmentHeader := textproto.MIMEHeader{}
-		attachmentHeader.Set("Content-Type", mime.TypeByExtension(filepath.Ext(attachmentPath)))
-		attachmentHeader.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filepath.Base(attachmentPath)))
-		attachmentHeader.Set("Content-Transfer-Encoding", "base64")
-		attachmentPart, err := writer.CreatePart(attachmentHeader)
+		return message, nil
+	}
+
+	// Preamble and epilogue, shown by clients that don't understand multipart
+	preamble := emailConfig.MultipartPreamble
+	if preamble == "" {
+		preamble = defaultMultipartPreamble
+	}
+	if emailConfig.OmitMultipartPreamble {
+		preamble = ""
+	}
+	if !isASCII(preamble) || !isASCII(emailConfig.MultipartEpilogue) {
+		return nil, errors.New("multipart preamble and epilogue must be ASCII")
+	}
+	if preamble != "" {
+		message.head.WriteString(normalizeLineEndings(preamble) + "\r\n")
+	}
+	if emailConfig.MultipartEpilogue != "" {
+		message.epilogue = normalizeLineEndings(emailConfig.MultipartEpilogue) + "\r\n"
+	}
+
+	// Body part
+	if bodyType != "" && body != "" {
+		// If the body has a custom Content-Type
+		if err = writeTextPart(writer, bodyType, body, options.sevenBit); err != nil {
+			return nil, err
+		}
+	} else if body != "" && htmlBody != "" {
+		// If both text and HTML are provided
+		altWriter, err := newMultipartWriter(&message.head, boundary, body, htmlBody)
 		if err != nil {
 			return nil, err
 		}
-		encoded := base64.StdEncoding.EncodeToString(attachment)
-		_, err = attachmentPart.Write([]byte(encoded))
+		altHeader := textproto.MIMEHeader{}
+		altHeader.Set("Content-Type", "multipart/alternative; boundary="+altWriter.Boundary())
+		altHeader.Set("Content-Transfer-Encoding", containerEncoding)
+		if _, err = writer.CreatePart(altHeader); err != nil {
+			return nil, err
+		}
+
+		// Plain text part
+		if err = writeTextPart(altWriter, textType, body, options.sevenBit); err != nil {
+			return nil, err
+		}
+
+		// HTML part
+		if err = writeTextPart(altWriter, "text/html; charset="+charset, htmlBody, options.sevenBit); err != nil {
+			return nil, err
+		}
+
+		err = altWriter.Close()
 		if err != nil {
 			return nil, err
 		}
+	} else if body != "" {
+		// If only text is provided
+		if err = writeTextPart(writer, textType, body, options.sevenBit); err != nil {
+			return nil, err
+		}
+	} else if htmlBody != "" {
+		// If only HTML is provided
+		if err = writeTextPart(writer, "text/html; charset="+charset, htmlBody, options.sevenBit); err != nil {
+			return nil, err
+		}
+	} else if attachmentPath == "" || !emailConfig.AllowAttachmentOnly {
+		return nil, errors.New("neither body nor htmlBody provided")
+	}
+
+	message.hasParts = body != "" || htmlBody != ""
+	message.attachmentPath = attachmentPath
+	message.attachmentInline = inline
+	if options.attachmentHash != "" {
+		checksum, err := hex.DecodeString(options.attachmentHash)
+		if err != nil || len(checksum) != sha256.Size {
+			return nil, errors.New("invalid attachment SHA-256 checksum: " + options.attachmentHash)
+		}
+		message.attachmentSHA256 = checksum
 	}
 
-	err := writer.Close()
+	return message, nil
+}
+
+// reservedHeaders can't be set through WithHeader because the message structure
+// or the standard headers depend on them. Keys are in canonical form.
+var reservedHeaders = map[string]bool{
+	"Mime-Version":              true,
+	"Content-Type":              true,
+	"Content-Transfer-Encoding": true,
+	"From":                      true,
+	"Sender":                    true,
+	"Reply-To":                  true,
+	"To":                        true,
+	"Cc":                        true,
+	"Bcc":                       true,
+	"Subject":                   true,
+	"Date":                      true,
+	"Message-Id":                true,
+	"In-Reply-To":               true,
+	"References":                true,
+}
+
+// customHeader validates a custom header and returns it encoded and folded
+func customHeader(name, value, charset string) (string, error) {
+	if reservedHeaders[textproto.CanonicalMIMEHeaderKey(name)] {
+		return "", errors.New("header can't be overridden: " + name)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return "", errors.New("header value contains CR or LF: " + name)
+	}
+	encoded, err := encodeHeaderCharset(value, charset)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	line := foldHeader(name + ": " + encoded)
+	if err = validateHeaderLine(line); err != nil {
+		return "", err
 	}
+	return line, nil
+}
 
-	return buf.Bytes(), nil
+// validateHeaderLine checks that line is a single, possibly folded, "Name: value" header
+func validateHeaderLine(line string) error {
+	name, _, found := strings.Cut(line, ":")
+	if !found || name == "" {
+		return errors.New("invalid header line: " + line)
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return errors.New("invalid header name: " + name)
+		}
+	}
+	for i, physical := range strings.Split(line, "\r\n") {
+		if strings.ContainsAny(physical, "\r\n") {
+			return errors.New("header line contains a bare CR or LF: " + name)
+		}
+		if i > 0 && (physical == "" || (physical[0] != ' ' && physical[0] != '\t')) {
+			return errors.New("header line continuation must be folded: " + name)
+		}
+	}
+	return nil
+}
+
+// writeTextPart writes a text part, declaring 8bit for non-ASCII content or
+// encoding it as quoted-printable when the message must be 7-bit clean
+func writeTextPart(writer *multipart.Writer, contentType, content string, sevenBit bool) error {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType)
+	if encoding := textEncoding(content, sevenBit); encoding != "7bit" {
+		header.Set("Content-Transfer-Encoding", encoding)
+	}
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	return writeText(part, content, sevenBit)
+}
+
+// textEncoding returns the Content-Transfer-Encoding writeText uses for content
+func textEncoding(content string, sevenBit bool) string {
+	if isASCII(content) {
+		return "7bit"
+	}
+	if sevenBit {
+		return "quoted-printable"
+	}
+	return "8bit"
+}
+
+// writeText writes content in the textEncoding encoding
+func writeText(w io.Writer, content string, sevenBit bool) error {
+	if textEncoding(content, sevenBit) == "quoted-printable" {
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(content)); err != nil {
+			return err
+		}
+		return qp.Close()
+	}
+	_, err := io.WriteString(w, content)
+	return err
+}
+
+// isASCII reports whether s contains only 7-bit characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] > unicode.MaxASCII {
+			return false
+		}
+	}
+	return true
+}
+
+// Limits for EmailConfig.BoundaryLength
+const (
+	minBoundaryLength = 16
+	maxBoundaryLength = 70
+)
+
+// boundaryAlphabet is the restricted alphabet of generated boundaries
+const boundaryAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// newMultipartWriter returns a multipart writer whose boundary doesn't occur
+// in content and is distinct from the enclosing parent boundary. The boundary
+// is a restricted alphanumeric one when BoundaryLength is configured and is
+// read from RandomSource when that is set.
+func newMultipartWriter(w io.Writer, parent string, content ...string) (*multipart.Writer, error) {
+	writer := multipart.NewWriter(w)
+	length := emailConfig.BoundaryLength
+	if length == 0 && emailConfig.RandomSource != nil {
+		length = len(writer.Boundary())
+	}
+	if length != 0 && (length < minBoundaryLength || length > maxBoundaryLength) {
+		return nil, fmt.Errorf("boundary length must be between %d and %d", minBoundaryLength, maxBoundaryLength)
+	}
+
+	// Regenerate until the boundary doesn't collide
+	for i := 0; i < 10; i++ {
+		if length != 0 {
+			boundary, err := randomBoundary(length)
+			if err != nil {
+				return nil, err
+			}
+			if err := writer.SetBoundary(boundary); err != nil {
+				return nil, err
+			}
+		}
+		if !boundaryCollides(writer.Boundary(), parent, content) {
+			return writer, nil
+		}
+		writer = multipart.NewWriter(w)
+	}
+	return nil, errors.New("could not generate a boundary that doesn't collide with the content")
+}
+
+// boundaryCollides reports whether boundary occurs in content or overlaps the
+// parent boundary, in which case a parser could end the wrong part
+func boundaryCollides(boundary, parent string, content []string) bool {
+	if parent != "" && (strings.Contains(parent, boundary) || strings.Contains(boundary, parent)) {
+		return true
+	}
+	for _, c := range content {
+		if strings.Contains(c, boundary) {
+			return true
+		}
+	}
+	return false
+}
+
+// randomBoundary returns a random alphanumeric boundary of length characters
+// read from RandomSource or crypto/rand, failing when the source can't supply
+// enough bytes
+func randomBoundary(length int) (string, error) {
+	source := emailConfig.RandomSource
+	if source == nil {
+		source = rand.Reader
+	}
+	boundary := make([]byte, 0, length)
+	random := make([]byte, length)
+	for len(boundary) < length {
+		if _, err := io.ReadFull(source, random); err != nil {
+			return "", fmt.Errorf("reading boundary randomness: %w", err)
+		}
+		for _, b := range random {
+			// Skip bytes past the last multiple of the alphabet size so every
+			// character is equally likely
+			if int(b) >= 256/len(boundaryAlphabet)*len(boundaryAlphabet) {
+				continue
+			}
+			boundary = append(boundary, boundaryAlphabet[int(b)%len(boundaryAlphabet)])
+			if len(boundary) == length {
+				break
+			}
+		}
+	}
+	return string(boundary), nil
 }
@@ -0,0 +1,838 @@
+package gosmtpmail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSkipMissingAttachments(t *testing.T) {
+	server := newFakeServer(t)
+	dir, present := writeAttachment(t, "report.txt", []byte("quarterly numbers"))
+	missing := filepath.Join(dir, "missing.txt")
+	config := serverConfig(server)
+	config.SkipMissingAttachments = true
+	useConfig(t, config)
+
+	var skipped []string
+	for _, path := range []string{present, missing} {
+		if err := Send("Report", "See attached", "", path, []string{"jane@example.com"}, WithSkippedAttachments(&skipped)); err != nil {
+			t.Fatalf("sending %s: %v", path, err)
+		}
+	}
+
+	if len(skipped) != 1 || skipped[0] != missing {
+		t.Errorf("skipped = %q, want [%q]", skipped, missing)
+	}
+	messages := server.Messages()
+	if len(messages) != 2 {
+		t.Fatalf("got %d messages, want 2", len(messages))
+	}
+	if !strings.Contains(messages[0], "filename=report.txt") {
+		t.Errorf("present attachment missing from first message:\n%s", messages[0])
+	}
+	if strings.Contains(messages[1], "missing.txt") {
+		t.Errorf("missing attachment referenced in second message:\n%s", messages[1])
+	}
+}
+
+func TestMissingAttachmentFailsByDefault(t *testing.T) {
+	server := newFakeServer(t)
+	useConfig(t, serverConfig(server))
+
+	if err := Send("Report", "See attached", "", filepath.Join(t.TempDir(), "missing.txt"), []string{"jane@example.com"}); err == nil {
+		t.Fatal("send with a missing attachment succeeded")
+	}
+	if len(server.Messages()) != 0 {
+		t.Error("message sent despite the missing attachment")
+	}
+}
+
+func TestBoundaryRestrictedCharset(t *testing.T) {
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com", BoundaryLength: 24})
+
+	message := composeMessage(t, "Boundary", "text", "<p>html</p>", "", []string{"jane@example.com"})
+	_, params, err := mime.ParseMediaType(parseMessage(t, message).Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	outer := params["boundary"]
+	if !regexp.MustCompile(`^[0-9A-Za-z]{24}$`).MatchString(outer) {
+		t.Errorf("boundary %q isn't 24 alphanumeric characters", outer)
+	}
+
+	inner := regexp.MustCompile(`multipart/alternative; boundary=(\S+)`).FindStringSubmatch(string(message))
+	if inner == nil {
+		t.Fatalf("no nested boundary:\n%s", message)
+	}
+	if !regexp.MustCompile(`^[0-9A-Za-z]{24}$`).MatchString(inner[1]) {
+		t.Errorf("nested boundary %q isn't 24 alphanumeric characters", inner[1])
+	}
+	if strings.Contains(inner[1], outer) || strings.Contains(outer, inner[1]) {
+		t.Errorf("nested boundary %q overlaps %q", inner[1], outer)
+	}
+}
+
+func TestBoundaryLengthLimits(t *testing.T) {
+	for _, length := range []int{1, 15, 71} {
+		useConfig(t, EmailConfig{EmailAddress: "sender@example.com", BoundaryLength: length})
+		if _, err := createEmailMessage("Boundary", "text", "", "", []string{"jane@example.com"}, messageOptions{}); err == nil {
+			t.Errorf("BoundaryLength %d accepted", length)
+		}
+	}
+}
+
+func TestBoundaryAvoidsParent(t *testing.T) {
+	// A source that repeats itself would produce the parent boundary again
+	useConfig(t, EmailConfig{BoundaryLength: 16, RandomSource: bytes.NewReader(bytes.Repeat([]byte{1}, 1024))})
+	if _, err := newMultipartWriter(io.Discard, "1111111111111111"); err == nil {
+		t.Error("boundary equal to the parent boundary accepted")
+	}
+	if _, err := newMultipartWriter(io.Discard, "", "content with 1111111111111111 in it"); err == nil {
+		t.Error("boundary occurring in the content accepted")
+	}
+}
+
+func TestSetConfigEPasswordFile(t *testing.T) {
+	useConfig(t, EmailConfig{})
+	_, path := writeAttachment(t, "password", []byte("from-file\n"))
+
+	if err := SetConfigE(EmailConfig{Password: "inline", PasswordFile: path}); err != nil {
+		t.Fatal(err)
+	}
+	if emailConfig.Password != "from-file" {
+		t.Errorf("Password = %q, want the file contents without the newline", emailConfig.Password)
+	}
+
+	if err := SetConfigE(EmailConfig{PasswordFile: filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Error("missing password file accepted")
+	}
+	if emailConfig.Password != "from-file" {
+		t.Error("failed SetConfigE replaced the configuration")
+	}
+}
+
+func TestSetConfigKeepsPreviousConfigOnError(t *testing.T) {
+	useConfig(t, EmailConfig{Host: "smtp.example.com"})
+
+	SetConfig(EmailConfig{Host: "other.example.com", AuthMechanism: "KERBEROS"})
+	if emailConfig.Host != "smtp.example.com" {
+		t.Errorf("invalid configuration applied, Host = %q", emailConfig.Host)
+	}
+	if err := ValidateConfig(EmailConfig{AuthMechanism: "KERBEROS"}); err == nil {
+		t.Error("unsupported auth mechanism accepted")
+	}
+}
+
+func TestOnErrorFiresOnceOnFinalFailure(t *testing.T) {
+	server := newFakeServer(t, func(s *fakeServer) {
+		s.replies = map[string]string{"RCPT TO:<bounce@": "550 5.1.1 no such user"}
+	})
+	type report struct {
+		subject string
+		to      []string
+		err     error
+	}
+	var reports []report
+	config := serverConfig(server)
+	config.OnError = func(subject string, to []string, err error) {
+		reports = append(reports, report{subject, to, err})
+	}
+	useConfig(t, config)
+
+	if err := Send("Delivered", "body", "", "", []string{"jane@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 0 {
+		t.Fatalf("OnError called for a successful send: %v", reports[0].err)
+	}
+
+	err := Send("Bounced", "body", "", "", []string{"bounce@example.com"})
+	if err == nil {
+		t.Fatal("send to a rejected recipient succeeded")
+	}
+	if len(reports) != 1 {
+		t.Fatalf("OnError called %d times, want 1", len(reports))
+	}
+	if reports[0].subject != "Bounced" || reports[0].to[0] != "bounce@example.com" || reports[0].err != err {
+		t.Errorf("OnError got %q, %q, %v; want the failed message and its error", reports[0].subject, reports[0].to, reports[0].err)
+	}
+
+	raw := []byte("From: sender@example.com\r\nTo: bounce@example.com\r\nSubject: Raw\r\n\r\nbody\r\n")
+	if err := SendEnvelope("sender@example.com", []string{"bounce@example.com"}, raw); err == nil {
+		t.Fatal("SendEnvelope to a rejected recipient succeeded")
+	}
+	if len(reports) != 2 || reports[1].subject != "Raw" {
+		t.Errorf("OnError not called with the envelope's subject: %d reports", len(reports))
+	}
+}
+
+func TestAutoResponseSuppressHeader(t *testing.T) {
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com", AutoResponseSuppress: []string{"OOF", "AutoReply"}})
+
+	msg := parseMessage(t, composeMessage(t, "Automated", "body", "", "", []string{"jane@example.com"}))
+	if got := msg.Header.Get("X-Auto-Response-Suppress"); got != "OOF, AutoReply" {
+		t.Errorf("X-Auto-Response-Suppress = %q, want %q", got, "OOF, AutoReply")
+	}
+
+	emailConfig.AutoResponseSuppress = []string{"Vacation"}
+	if _, err := createEmailMessage("Automated", "body", "", "", []string{"jane@example.com"}, messageOptions{}); err == nil {
+		t.Error("unknown X-Auto-Response-Suppress value accepted")
+	}
+
+	emailConfig.AutoResponseSuppress = nil
+	msg = parseMessage(t, composeMessage(t, "Automated", "body", "", "", []string{"jane@example.com"}))
+	if _, ok := msg.Header["X-Auto-Response-Suppress"]; ok {
+		t.Error("X-Auto-Response-Suppress emitted by default")
+	}
+}
+
+func TestReportAbuseHeader(t *testing.T) {
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com"})
+	to := []string{"jane@example.com"}
+
+	msg := parseMessage(t, composeMessage(t, "Default", "body", "", "", to))
+	if _, ok := msg.Header["X-Report-Abuse"]; ok {
+		t.Error("X-Report-Abuse emitted by default")
+	}
+
+	for _, uri := range []string{"mailto:abuse@example.com", "https://example.com/report?id=42"} {
+		emailConfig.ReportAbuseURI = uri
+		msg = parseMessage(t, composeMessage(t, "Reportable", "body", "", "", to))
+		if got := msg.Header.Get("X-Report-Abuse"); got != "<"+uri+">" {
+			t.Errorf("X-Report-Abuse = %q, want <%s>", got, uri)
+		}
+	}
+
+	for _, uri := range []string{"ftp://example.com/report", "https://example.com/a b", "not a uri"} {
+		emailConfig.ReportAbuseURI = uri
+		if _, err := createEmailMessage("Reportable", "body", "", "", to, messageOptions{}); err == nil {
+			t.Errorf("invalid X-Report-Abuse URI %q accepted", uri)
+		}
+	}
+}
+
+func TestMaxHeaderCount(t *testing.T) {
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com", MaxHeaderCount: 20})
+
+	var opts []MessageOption
+	for i := 0; i < 30; i++ {
+		opts = append(opts, WithHeader(fmt.Sprintf("X-Custom-%d", i), "value"))
+	}
+	_, err := createEmailMessage("Headers", "body", "", "", []string{"jane@example.com"}, newMessageOptions(opts))
+	if err == nil || !strings.Contains(err.Error(), "more than the limit of 20") {
+		t.Errorf("30 custom headers under a limit of 20 returned %v", err)
+	}
+
+	composeMessage(t, "Headers", "body", "", "", []string{"jane@example.com"}, opts[:2]...)
+}
+
+func TestRecipientRewrite(t *testing.T) {
+	server := newFakeServer(t)
+	config := serverConfig(server)
+	config.BccAddressToSendCopy = "archive@prod.com"
+	config.RecipientRewrite = func(addr string) string {
+		return strings.Replace(addr, "@prod.com", "@staging.test", 1)
+	}
+	useConfig(t, config)
+
+	if err := Send("Canary", "body", "", "", []string{"Jane <jane@prod.com>", "bob@other.org"}); err != nil {
+		t.Fatal(err)
+	}
+	var rcpts []string
+	for _, command := range server.Commands() {
+		if strings.HasPrefix(command, "RCPT TO:") {
+			rcpts = append(rcpts, command)
+		}
+	}
+	want := []string{"RCPT TO:<jane@staging.test>", "RCPT TO:<bob@other.org>", "RCPT TO:<archive@staging.test>"}
+	if strings.Join(rcpts, ",") != strings.Join(want, ",") {
+		t.Errorf("envelope recipients = %q, want %q", rcpts, want)
+	}
+	msg := parseMessage(t, []byte(server.Messages()[0]))
+	if got := msg.Header.Get("To"); got != `"Jane" <jane@staging.test>, bob@other.org` {
+		t.Errorf("To header = %q, want the rewritten addresses", got)
+	}
+
+	// SendEnvelope rewrites the envelope but sends the body verbatim
+	raw := []byte("To: jane@prod.com\r\nSubject: Raw\r\n\r\nbody\r\n")
+	if err := SendEnvelope("sender@example.com", []string{"jane@prod.com"}, raw); err != nil {
+		t.Fatal(err)
+	}
+	if got := rcptCommands(server)[len(want):]; fmt.Sprint(got) != "[RCPT TO:<jane@staging.test>]" {
+		t.Errorf("SendEnvelope recipients = %q, want the rewritten address", got)
+	}
+	if got := server.Messages()[1]; got != string(raw) {
+		t.Errorf("SendEnvelope body = %q, want it verbatim", got)
+	}
+
+	emailConfig.RecipientRewrite = func(addr string) string { return "not an address" }
+	if err := Send("Canary", "body", "", "", []string{"jane@prod.com"}); err == nil {
+		t.Error("invalid rewritten address accepted")
+	}
+	if err := SendEnvelope("sender@example.com", []string{"jane@prod.com"}, raw); err == nil {
+		t.Error("invalid rewritten envelope address accepted")
+	}
+}
+
+func TestDeriveSenderName(t *testing.T) {
+	useConfig(t, EmailConfig{EmailAddress: "support@x.example", DeriveSenderName: true})
+	msg := parseMessage(t, composeMessage(t, "Hello", "body", "", "", []string{"jane@example.com"}))
+	if got := msg.Header.Get("From"); got != "Support <support@x.example>" {
+		t.Errorf("From = %q, want the derived name Support", got)
+	}
+
+	emailConfig.DeriveSenderName = false
+	msg = parseMessage(t, composeMessage(t, "Hello", "body", "", "", []string{"jane@example.com"}))
+	if got := msg.Header.Get("From"); got != "<support@x.example>" {
+		t.Errorf("From = %q, want the bare address by default", got)
+	}
+}
+
+func TestSenderNameQuoting(t *testing.T) {
+	for _, name := range []string{"Doe, Jane", `Jane "JD" Doe`, "Support (EU)", "Jörg Müller", "Plain Name"} {
+		useConfig(t, EmailConfig{EmailAddress: "sender@example.com", SenderName: name})
+		msg := parseMessage(t, composeMessage(t, "Hello", "body", "", "", []string{"jane@example.com"}))
+		addresses, err := msg.Header.AddressList("From")
+		if err != nil || len(addresses) != 1 {
+			t.Errorf("From %q for SenderName %q doesn't parse as one address: %v", msg.Header.Get("From"), name, err)
+			continue
+		}
+		if addresses[0].Name != name || addresses[0].Address != "sender@example.com" {
+			t.Errorf("From %q parsed as %q <%s>, want %q", msg.Header.Get("From"), addresses[0].Name, addresses[0].Address, name)
+		}
+	}
+}
+
+func TestAttachSourceToBccCopy(t *testing.T) {
+	server := newFakeServer(t)
+	config := serverConfig(server)
+	config.BccAddressToSendCopy = "debug@example.com"
+	config.AttachSourceToBccCopy = true
+	useConfig(t, config)
+
+	if err := Send("Order shipped", "Your order is on its way", "", "", []string{"jane@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	messages := server.Messages()
+	if len(messages) != 2 {
+		t.Fatalf("got %d messages, want the message and its debug copy", len(messages))
+	}
+
+	debug := parseMessage(t, []byte(messages[1]))
+	if got := debug.Header.Get("To"); got != "debug@example.com" {
+		t.Errorf("debug copy To = %q", got)
+	}
+	_, params, err := mime.ParseMediaType(debug.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := multipart.NewReader(debug.Body, params["boundary"])
+	var original []byte
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		if part.Header.Get("Content-Type") == "message/rfc822" {
+			original, _ = io.ReadAll(part)
+		}
+	}
+	if original == nil {
+		t.Fatalf("debug copy has no message/rfc822 part:\n%s", messages[1])
+	}
+	if string(original) != messages[0] {
+		t.Errorf("attached message differs from the sent one:\n%s\n---\n%s", original, messages[0])
+	}
+}
+
+func TestEmptySubject(t *testing.T) {
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com"})
+
+	message := string(composeMessage(t, "", "body", "", "", []string{"jane@example.com"}))
+	if strings.Contains(message, "=?") {
+		t.Errorf("empty subject produced an encoded word:\n%s", message)
+	}
+	if strings.Contains(message, "Subject:") {
+		t.Errorf("empty subject not omitted by default:\n%s", message)
+	}
+
+	emailConfig.KeepEmptySubject = true
+	message = string(composeMessage(t, "", "body", "", "", []string{"jane@example.com"}))
+	if !strings.Contains(message, "\r\nSubject: \r\n") || strings.Contains(message, "=?") {
+		t.Errorf("KeepEmptySubject didn't emit a plain empty Subject:\n%s", message)
+	}
+}
+
+func TestAttachmentOnly(t *testing.T) {
+	prefix, path := writeAttachment(t, "forward.pdf", []byte("%PDF-1.4"))
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com", AttachmentPathPrefix: prefix})
+
+	if _, err := createEmailMessage("Forward", "", "", path, []string{"jane@example.com"}, messageOptions{}); err == nil {
+		t.Error("attachment-only message accepted without AllowAttachmentOnly")
+	}
+
+	emailConfig.AllowAttachmentOnly = true
+	msg := parseMessage(t, composeMessage(t, "Forward", "", "", path, []string{"jane@example.com"}))
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	var types []string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, part.Header.Get("Content-Type"))
+	}
+	if len(types) != 1 || types[0] != "application/pdf" {
+		t.Errorf("parts = %q, want only the attachment", types)
+	}
+}
+
+func TestEncodeHeaderChoosesShorterEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		prefix string
+	}{
+		{"Café opening hours", "=?UTF-8?q?"},
+		{"日本語の件名", "=?UTF-8?b?"},
+		{"plain ASCII", "plain ASCII"},
+	}
+	for _, tt := range tests {
+		encoded := encodeHeader(tt.header)
+		if !strings.HasPrefix(encoded, tt.prefix) {
+			t.Errorf("encodeHeader(%q) = %q, want prefix %q", tt.header, encoded, tt.prefix)
+		}
+		decoded, err := new(mime.WordDecoder).DecodeHeader(encoded)
+		if err != nil || decoded != tt.header {
+			t.Errorf("encodeHeader(%q) decodes to %q, %v", tt.header, decoded, err)
+		}
+	}
+}
+
+func TestEncodeHeaderSplitsLongWords(t *testing.T) {
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com"})
+	long := "Sipariş güncellemesi: Ödemeniz başarıyla alındı ve kargonuz çok yakında şubemizden yola çıkacaktır, teşekkürler"
+
+	for _, subject := range []string{long, string([]rune(long)[:40]), "Grüße " + strings.Repeat("a", 50), "Café"} {
+		message := string(composeMessage(t, subject, "body", "", "", []string{"jane@example.com"}))
+		header := regexp.MustCompile(`Subject:.*\r\n( .*\r\n)*`).FindString(message)
+		if header == "" {
+			t.Fatalf("no Subject header:\n%s", message)
+		}
+		lines := strings.Split(strings.TrimSuffix(header, "\r\n"), "\r\n")
+		decoder := new(mime.WordDecoder)
+		for i, line := range lines {
+			if len(line) > maxEncodedLineLength {
+				t.Errorf("Subject line %q is %d characters, over the limit of %d", line, len(line), maxEncodedLineLength)
+			}
+			if i > 0 && !strings.HasPrefix(line, " ") {
+				t.Errorf("continuation line %q isn't folded with a space", line)
+			}
+			// Each word decodes on its own, so no character is split across words
+			if word := strings.TrimSpace(strings.TrimPrefix(line, "Subject:")); word != "" {
+				if decoded, err := decoder.Decode(word); err != nil || !utf8.ValidString(decoded) {
+					t.Errorf("encoded word %q doesn't decode to valid UTF-8: %q, %v", word, decoded, err)
+				}
+			}
+		}
+		if subject == long && len(lines) < 3 {
+			t.Errorf("long subject not split into several words: %q", header)
+		}
+		decoded, err := decoder.DecodeHeader(parseMessage(t, []byte(message)).Header.Get("Subject"))
+		if err != nil || decoded != subject {
+			t.Errorf("subject decodes to %q, %v, want %q", decoded, err, subject)
+		}
+	}
+}
+
+func TestReplyToDedupAndCap(t *testing.T) {
+	useConfig(t, EmailConfig{
+		EmailAddress: "sender@example.com",
+		ReplyTo:      "Support <support@example.com>, SUPPORT@example.com, Ünal <unal@example.com>, billing@example.com",
+		MaxReplyTo:   2,
+	})
+
+	message := composeMessage(t, "Reply", "body", "", "", []string{"jane@example.com"})
+	if got := strings.Count(string(message), "Reply-To:"); got != 1 {
+		t.Errorf("got %d Reply-To headers, want 1", got)
+	}
+	addresses, err := parseMessage(t, message).Header.AddressList("Reply-To")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addresses) != 2 || addresses[0].Address != "support@example.com" || addresses[1].Address != "unal@example.com" || addresses[1].Name != "Ünal" {
+		t.Errorf("Reply-To = %v, want support@ and Ünal <unal@> only", addresses)
+	}
+	if !isASCII(string(message)) {
+		t.Errorf("non-ASCII display name not encoded:\n%s", message)
+	}
+}
+
+func TestMultipartContainersDeclareSevenBit(t *testing.T) {
+	prefix, path := writeAttachment(t, "report.pdf", []byte("%PDF-1.4"))
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com", AttachmentPathPrefix: prefix})
+
+	msg := parseMessage(t, composeMessage(t, "Containers", "text", "<p>html</p>", path, []string{"jane@example.com"}))
+	if got := msg.Header.Get("Content-Transfer-Encoding"); got != "7bit" {
+		t.Errorf("root Content-Transfer-Encoding = %q, want 7bit", got)
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	part, err := reader.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, altParams, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("first part is %q, want multipart/alternative", mediaType)
+	}
+	if got := part.Header.Get("Content-Transfer-Encoding"); got != "7bit" {
+		t.Errorf("multipart/alternative Content-Transfer-Encoding = %q, want 7bit", got)
+	}
+
+	// The standard library reader still sees both alternatives and the attachment
+	alt := multipart.NewReader(part, altParams["boundary"])
+	count := 0
+	for {
+		if _, err := alt.NextPart(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	if count != 2 {
+		t.Errorf("multipart/alternative has %d parts, want 2", count)
+	}
+	if attachment, err := reader.NextPart(); err != nil || attachment.FileName() != "report.pdf" {
+		t.Errorf("attachment part not read: %v", err)
+	}
+}
+
+func TestMultipartContainersDeclareEightBit(t *testing.T) {
+	tests := []struct {
+		name       string
+		extensions []string
+		want       string
+	}{
+		{"8BITMIME", []string{"8BITMIME", "AUTH PLAIN"}, "8bit"},
+		{"7-bit fallback", []string{"AUTH PLAIN"}, "7bit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeServer(t, func(s *fakeServer) { s.extensions = tt.extensions })
+			useConfig(t, serverConfig(server))
+
+			if err := Send("Grüße", "Schöne Grüße", "<p>Schöne Grüße</p>", "", []string{"jane@example.com"}); err != nil {
+				t.Fatal(err)
+			}
+			message := server.Messages()[0]
+			msg := parseMessage(t, []byte(message))
+			if got := msg.Header.Get("Content-Transfer-Encoding"); got != tt.want {
+				t.Errorf("root Content-Transfer-Encoding = %q, want %q", got, tt.want)
+			}
+			if !strings.Contains(message, "multipart/alternative; boundary=") {
+				t.Fatalf("no multipart/alternative part:\n%s", message)
+			}
+			alt := regexp.MustCompile(`Content-Transfer-Encoding: (\S+)\r\nContent-Type: multipart/alternative`).FindStringSubmatch(message)
+			if alt == nil || alt[1] != tt.want {
+				t.Errorf("multipart/alternative Content-Transfer-Encoding = %q, want %q:\n%s", alt, tt.want, message)
+			}
+		})
+	}
+}
+
+// messageBody returns the body of a composed message, after the header block
+func messageBody(message []byte) string {
+	_, body, _ := strings.Cut(string(message), "\r\n\r\n")
+	return body
+}
+
+func TestBodyEndsWithSingleCRLF(t *testing.T) {
+	to := []string{"jane@example.com"}
+	compose := func(body string) string {
+		useConfig(t, EmailConfig{EmailAddress: "sender@example.com", RandomSource: rand.New(rand.NewSource(1))})
+		return messageBody(composeMessage(t, "Canonical", body, "<p>line one</p>\n<p>line two</p>\n\n", "", to))
+	}
+
+	body := compose("line one\nline two\n\n\n")
+	if !strings.HasSuffix(body, "\r\n") || strings.HasSuffix(body, "\r\n\r\n") {
+		t.Errorf("body doesn't end with exactly one CRLF: %q", body[max(0, len(body)-20):])
+	}
+	if strings.Contains(strings.ReplaceAll(body, "\r\n", ""), "\n") || strings.Contains(strings.ReplaceAll(body, "\r\n", ""), "\r") {
+		t.Error("body contains bare CR or LF line endings")
+	}
+
+	// DKIM simple body canonicalization (RFC 6376 3.4.3) leaves the body as is,
+	// and other line endings in the input give the same bytes
+	canonical := strings.TrimRight(body, "\r\n") + "\r\n"
+	if canonical != body {
+		t.Error("simple body canonicalization changes the body")
+	}
+	if other := compose("line one\r\nline two\r\n\r\n\r\n"); other != body {
+		t.Errorf("CRLF input gives a different body:\n%q\n%q", other, body)
+	}
+}
+
+func TestToHeaderAddresses(t *testing.T) {
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com"})
+
+	to := []string{`"Jane Doe" <jane@example.com>`, "bob@example.com", "Jörg Müller <joerg@example.com>"}
+	message := composeMessage(t, "Named", "body", "", "", to)
+	if !strings.Contains(string(message), "To: \"Jane Doe\" <jane@example.com>,\r\n bob@example.com,\r\n =?") {
+		t.Errorf("To header not emitted canonically:\n%s", message)
+	}
+	addresses, err := parseMessage(t, message).Header.AddressList("To")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Jane Doe <jane@example.com>", " <bob@example.com>", "Jörg Müller <joerg@example.com>"}
+	for i, address := range addresses {
+		if got := address.Name + " <" + address.Address + ">"; got != want[i] {
+			t.Errorf("To address %d = %q, want %q", i, got, want[i])
+		}
+	}
+
+	for _, invalid := range []string{"not an address", "Jane <jane@example.com", ""} {
+		if _, err := createEmailMessage("Named", "body", "", "", []string{invalid}, messageOptions{}); err == nil {
+			t.Errorf("invalid recipient %q accepted", invalid)
+		}
+	}
+}
+
+func TestSendEnvelope(t *testing.T) {
+	server := newFakeServer(t)
+	var reports []error
+	config := serverConfig(server)
+	config.OnError = func(subject string, to []string, err error) {
+		reports = append(reports, err)
+	}
+	config.QuotaStore = NewDailyQuotaStore(2)
+	useConfig(t, config)
+
+	// No headers are added, and a leading dot survives dot-stuffing
+	body := []byte("X-Relay: passthrough\r\n\r\n.leading dot\r\nlast line\r\n")
+	to := []string{"jane@example.com"}
+	if err := SendEnvelope("sender@example.com", to, body, WithIdempotencyKey("envelope-1"), WithTenant("acme")); err != nil {
+		t.Fatal(err)
+	}
+	if messages := server.Messages(); len(messages) != 1 || messages[0] != string(body) {
+		t.Fatalf("server received %q, want the body verbatim", messages)
+	}
+
+	if err := SendEnvelope("sender@example.com", to, body, WithIdempotencyKey("envelope-1"), WithTenant("acme")); !errors.Is(err, ErrDuplicateSend) {
+		t.Errorf("repeated idempotency key returned %v, want ErrDuplicateSend", err)
+	}
+	if err := SendEnvelope("sender@example.com", to, body, WithTenant("acme")); err != nil {
+		t.Fatal(err)
+	}
+	if err := SendEnvelope("sender@example.com", to, body, WithTenant("acme")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("send over the quota returned %v, want ErrQuotaExceeded", err)
+	}
+	if len(server.Messages()) != 2 {
+		t.Errorf("server received %d messages, want 2", len(server.Messages()))
+	}
+	if len(reports) != 1 || !errors.Is(reports[0], ErrQuotaExceeded) {
+		t.Errorf("OnError got %v, want only the quota failure", reports)
+	}
+
+	if err := SendEnvelope("not an address", to, body); err == nil {
+		t.Error("invalid sender accepted")
+	}
+}
+
+func TestBccOnlySend(t *testing.T) {
+	server := newFakeServer(t)
+	config := serverConfig(server)
+	config.BccAddressToSendCopy = "archive@example.com"
+	useConfig(t, config)
+
+	if err := Send("Archived", "body", "", "", nil); err != nil {
+		t.Fatalf("BCC-only send failed by default: %v", err)
+	}
+	if rcpt := server.command("RCPT TO:"); rcpt != "RCPT TO:<archive@example.com>" {
+		t.Errorf("RCPT = %q, want only the BCC address", rcpt)
+	}
+
+	emailConfig.RequireVisibleRecipient = true
+	connections := server.Connections()
+	if err := Send("Archived", "body", "", "", nil); !errors.Is(err, ErrNoVisibleRecipients) {
+		t.Errorf("BCC-only send with RequireVisibleRecipient returned %v, want ErrNoVisibleRecipients", err)
+	}
+	if server.Connections() != connections {
+		t.Error("server contacted for a refused BCC-only send")
+	}
+	if err := Send("Visible", "body", "", "", []string{"jane@example.com"}); err != nil {
+		t.Errorf("send with a visible recipient failed: %v", err)
+	}
+}
+
+func TestEnforceLineLength(t *testing.T) {
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com"})
+	to := []string{"jane@example.com"}
+	// A value without whitespace can't be folded below the limit
+	token := WithHeader("X-Token", strings.Repeat("t", 1200))
+
+	line := 0
+	for i, text := range strings.Split(string(composeMessage(t, "Long", "body", "", "", to, token)), "\r\n") {
+		if len(text)+2 > maxLineLength {
+			line = i + 1
+		}
+	}
+	if line == 0 {
+		t.Fatal("no over-length line without EnforceLineLength")
+	}
+
+	emailConfig.EnforceLineLength = true
+	_, err := createEmailMessage("Long", "body", "", "", to, newMessageOptions([]MessageOption{token}))
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("line %d is longer", line)) {
+		t.Errorf("over-length header returned %v, want an error for line %d", err, line)
+	}
+	composeMessage(t, "Short", "body", "", "", to, WithHeader("X-Token", "short"))
+}
+
+func TestRandomSourceBoundaries(t *testing.T) {
+	// Each byte below 62 maps to that position in the boundary alphabet
+	sequence := make([]byte, 620)
+	for i := range sequence {
+		sequence[i] = byte(i % 62)
+	}
+	to := []string{"jane@example.com"}
+
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com", BoundaryLength: 16, RandomSource: bytes.NewReader(sequence)})
+	message := composeMessage(t, "Fixed", "text", "<p>html</p>", "", to)
+	if !strings.Contains(string(message), "Content-Type: multipart/mixed; boundary=0123456789ABCDEF\r\n") {
+		t.Errorf("outer boundary isn't the first 16 alphabet characters:\n%s", message)
+	}
+	if !strings.Contains(string(message), "Content-Type: multipart/alternative; boundary=GHIJKLMNOPQRSTUV\r\n") {
+		t.Errorf("nested boundary isn't the next 16 alphabet characters:\n%s", message)
+	}
+
+	emailConfig.RandomSource = bytes.NewReader(sequence[:10])
+	_, err := createEmailMessage("Short", "text", "", "", to, messageOptions{})
+	if err == nil || !strings.Contains(err.Error(), "boundary randomness") {
+		t.Errorf("too-short random source returned %v, want a read error", err)
+	}
+}
+
+func TestMultipartPreambleAndEpilogue(t *testing.T) {
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com"})
+	to := []string{"jane@example.com"}
+
+	tests := []struct {
+		name     string
+		config   func(*EmailConfig)
+		preamble string
+	}{
+		{"default", func(*EmailConfig) {}, defaultMultipartPreamble + "\r\n"},
+		{"custom", func(c *EmailConfig) { c.MultipartPreamble = "Use a MIME reader." }, "Use a MIME reader.\r\n"},
+		{"omitted", func(c *EmailConfig) { c.OmitMultipartPreamble = true }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			emailConfig = EmailConfig{EmailAddress: "sender@example.com", MultipartEpilogue: "End of message."}
+			tt.config(&emailConfig)
+			message := composeMessage(t, "Preamble", "text", "<p>html</p>", "", to)
+
+			msg := parseMessage(t, message)
+			_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(msg.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			before, _, found := strings.Cut(string(body), "--"+params["boundary"]+"\r\n")
+			if !found || before != tt.preamble {
+				t.Errorf("text before the first boundary = %q, want %q", before, tt.preamble)
+			}
+			if !strings.HasSuffix(string(body), "--"+params["boundary"]+"--\r\nEnd of message.\r\n") {
+				t.Errorf("epilogue doesn't follow the closing boundary:\n%s", body)
+			}
+			// Neither is a part; the only part is the alternative
+			if types := partTypes(t, message); len(types) != 1 || !strings.HasPrefix(types[0], "multipart/alternative") {
+				t.Errorf("parts = %q, want only multipart/alternative", types)
+			}
+		})
+	}
+}
+
+// rcptCommands returns the RCPT TO commands received by server
+func rcptCommands(server *fakeServer) []string {
+	var rcpts []string
+	for _, command := range server.Commands() {
+		if strings.HasPrefix(command, "RCPT TO:") {
+			rcpts = append(rcpts, command)
+		}
+	}
+	return rcpts
+}
+
+func TestRecipientNormalization(t *testing.T) {
+	to := []string{" Jane@Example.COM ", "jane@example.com", "Bob@Example.org"}
+	tests := []struct {
+		name    string
+		disable bool
+		want    []string
+	}{
+		{"default", false, []string{"RCPT TO:<Jane@example.com>", "RCPT TO:<Bob@example.org>"}},
+		{"disabled", true, []string{"RCPT TO:<Jane@Example.COM>", "RCPT TO:<jane@example.com>", "RCPT TO:<Bob@Example.org>"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeServer(t)
+			config := serverConfig(server)
+			config.DisableRecipientNormalization = tt.disable
+			useConfig(t, config)
+
+			if err := Send("Normalized", "body", "", "", to); err != nil {
+				t.Fatal(err)
+			}
+			if got := rcptCommands(server); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("RCPT commands = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBccNormalizedWithRecipients(t *testing.T) {
+	server := newFakeServer(t)
+	config := serverConfig(server)
+	config.BccAddressToSendCopy = "Jane@Example.COM"
+	useConfig(t, config)
+
+	if err := Send("Normalized", "body", "", "", []string{"jane@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := rcptCommands(server); fmt.Sprint(got) != "[RCPT TO:<jane@example.com>]" {
+		t.Errorf("RCPT commands = %q, want the BCC deduplicated against To", got)
+	}
+
+	emailConfig.BccAddressToSendCopy = "Archive@Example.COM"
+	if err := Send("Normalized", "body", "", "", []string{"jane@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := rcptCommands(server)[1:]; fmt.Sprint(got) != "[RCPT TO:<jane@example.com> RCPT TO:<Archive@example.com>]" {
+		t.Errorf("RCPT commands = %q, want the BCC domain lowercased", got)
+	}
+}
@@ -0,0 +1,137 @@
+package gosmtpmail
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrQuotaExceeded is returned when the tenant's QuotaStore refuses the send
+var ErrQuotaExceeded = errors.New("sending quota exceeded")
+
+// ErrCircuitOpen is returned without contacting the server while the circuit breaker is open
+var ErrCircuitOpen = errors.New("smtp: circuit breaker open, server recently unavailable")
+
+// ErrNoVisibleRecipients is returned by RequireVisibleRecipient when the message has no To recipients
+var ErrNoVisibleRecipients = errors.New("no visible recipients")
+
+// ErrRemoteHTMLContent is returned by StrictHTML when the HTML body loads remote resources
+var ErrRemoteHTMLContent = errors.New("HTML body contains scripts or remote resources")
+
+// ErrAttachmentChecksumMismatch is returned when an attachment doesn't match its expected SHA-256 checksum
+var ErrAttachmentChecksumMismatch = errors.New("attachment checksum mismatch")
+
+// ErrUnencryptedAuthRefused is returned when credentials would be sent over a
+// connection without TLS; set TLSMode to TLSModeImplicit or TLSModeStartTLS
+var ErrUnencryptedAuthRefused = errors.New("smtp: refusing to authenticate over an unencrypted connection, enable TLS or STARTTLS")
+
+// ErrInvalidAttachmentPath is reported when an attachment path is outside the configured prefix
+var ErrInvalidAttachmentPath = errors.New("invalid attachment path")
+
+// ErrDuplicateSend is returned when a message with the same idempotency key was already sent
+var ErrDuplicateSend = errors.New("duplicate send, message with this idempotency key was already sent")
+
+// AttachmentPathError describes an attachment path that doesn't start with the expected prefix
+type AttachmentPathError struct {
+	Path   string
+	Prefix string
+}
+
+func (e *AttachmentPathError) Error() string {
+	return "attachment path must start with: " + e.Prefix
+}
+
+// Is makes errors.Is(err, ErrInvalidAttachmentPath) match
+func (e *AttachmentPathError) Is(target error) bool {
+	return target == ErrInvalidAttachmentPath
+}
+
+// SMTP conversation phases reported by SMTPError
+const (
+	PhaseConnect  = "CONNECT"
+	PhaseEHLO     = "EHLO"
+	PhaseStartTLS = "STARTTLS"
+	PhaseAuth     = "AUTH"
+	PhaseMail     = "MAIL"
+	PhaseRcpt     = "RCPT"
+	PhaseData     = "DATA"
+	PhaseQuit     = "QUIT"
+)
+
+// SMTPError records the phase and command of the SMTP conversation that failed
+type SMTPError struct {
+	Phase   string
+	Command string
+	Err     error
+}
+
+func (e *SMTPError) Error() string {
+	return fmt.Sprintf("smtp phase=%s cmd=%q: %v", e.Phase, e.Command, e.Err)
+}
+
+func (e *SMTPError) Unwrap() error {
+	return e.Err
+}
+
+// phaseError wraps err with the phase and command that failed
+func phaseError(phase, command string, err error) error {
+	return &SMTPError{Phase: phase, Command: command, Err: err}
+}
+
+// TLSVerificationError describes a server certificate that failed verification
+type TLSVerificationError struct {
+	// Host is the hostname the certificate was expected to be valid for
+	Host      string
+	Subject   string
+	Issuer    string
+	SANs      []string
+	NotBefore time.Time
+	NotAfter  time.Time
+	Err       error
+}
+
+func (e *TLSVerificationError) Error() string {
+	return fmt.Sprintf("tls: certificate subject=%q issuer=%q sans=[%s] expected host=%q: %v",
+		e.Subject, e.Issuer, strings.Join(e.SANs, " "), e.Host, e.Err)
+}
+
+func (e *TLSVerificationError) Unwrap() error {
+	return e.Err
+}
+
+// tlsVerificationError returns a TLSVerificationError for certificate
+// verification failures in err, and err itself otherwise
+func tlsVerificationError(err error, host string) error {
+	var cert *x509.Certificate
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var verificationErr *tls.CertificateVerificationError
+	switch {
+	case errors.As(err, &hostnameErr):
+		cert = hostnameErr.Certificate
+	case errors.As(err, &invalidErr):
+		cert = invalidErr.Cert
+	case errors.As(err, &verificationErr) && len(verificationErr.UnverifiedCertificates) > 0:
+		cert = verificationErr.UnverifiedCertificates[0]
+	}
+	if cert == nil {
+		return err
+	}
+
+	sans := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	return &TLSVerificationError{
+		Host:      host,
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		SANs:      sans,
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+		Err:       err,
+	}
+}
@@ -0,0 +1,28 @@
+package gosmtpmail
+
+import "regexp"
+
+var (
+	// scriptElementPattern matches script elements, including unterminated ones
+	scriptElementPattern = regexp.MustCompile(`(?is)<script\b.*?(</script\s*>|$)`)
+	// remoteSrcTagPattern matches tags loading a remote resource through src or background
+	remoteSrcTagPattern = regexp.MustCompile(`(?is)<[a-z][^>]*\s(src|background)\s*=\s*["']?\s*(https?:)?//[^>]*>`)
+	// remoteLinkTagPattern matches link tags (stylesheets, icons) pointing at a remote href
+	remoteLinkTagPattern = regexp.MustCompile(`(?is)<link\b[^>]*\shref\s*=\s*["']?\s*(https?:)?//[^>]*>`)
+)
+
+// enforceStrictHTML rejects, or strips when StripRemoteHTML is set, script
+// elements and tags that load remote resources
+func enforceStrictHTML(htmlBody string) (string, error) {
+	patterns := []*regexp.Regexp{scriptElementPattern, remoteSrcTagPattern, remoteLinkTagPattern}
+	for _, pattern := range patterns {
+		if !pattern.MatchString(htmlBody) {
+			continue
+		}
+		if !emailConfig.StripRemoteHTML {
+			return "", ErrRemoteHTMLContent
+		}
+		htmlBody = pattern.ReplaceAllString(htmlBody, "")
+	}
+	return htmlBody, nil
+}
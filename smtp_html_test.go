@@ -0,0 +1,60 @@
+package gosmtpmail
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestStrictHTMLRejectsTrackingPixel(t *testing.T) {
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com", StrictHTML: true})
+	to := []string{"jane@example.com"}
+	html := `<p>Hello</p><img src="https://tracker.example.com/pixel.gif" width="1" height="1">`
+
+	_, err := createEmailMessage("Tracked", "", html, "", to, messageOptions{})
+	if !errors.Is(err, ErrRemoteHTMLContent) {
+		t.Errorf("tracking pixel returned %v, want ErrRemoteHTMLContent", err)
+	}
+	if _, err := createEmailMessage("Script", "", `<p>Hi</p><script>alert(1)</script>`, "", to, messageOptions{}); !errors.Is(err, ErrRemoteHTMLContent) {
+		t.Errorf("script returned %v, want ErrRemoteHTMLContent", err)
+	}
+	composeMessage(t, "Local", "", `<p>Hi</p><img src="cid:logo.png">`, "", to)
+
+	emailConfig.StripRemoteHTML = true
+	message := string(composeMessage(t, "Tracked", "", html, "", to))
+	if strings.Contains(message, "tracker.example.com") || !strings.Contains(message, "<p>Hello</p>") {
+		t.Errorf("StripRemoteHTML didn't remove only the tracking pixel:\n%s", message)
+	}
+}
+
+// closeParagraphs is a minimal sanitizer that closes unclosed <p> tags
+func closeParagraphs(html string) (string, error) {
+	if strings.Contains(html, "<script") {
+		return "", errors.New("script not allowed")
+	}
+	return html + strings.Repeat("</p>", strings.Count(html, "<p>")-strings.Count(html, "</p>")), nil
+}
+
+func TestHTMLSanitizer(t *testing.T) {
+	to := []string{"jane@example.com"}
+	malformed := "<p>one<p>two"
+
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com"})
+	if message := string(composeMessage(t, "Unchanged", "", malformed, "", to)); !strings.Contains(message, "\r\n\r\n"+malformed+"\r\n") {
+		t.Errorf("HTML changed without a sanitizer:\n%s", message)
+	}
+
+	emailConfig.HTMLSanitizer = closeParagraphs
+	if message := string(composeMessage(t, "Repaired", "", malformed, "", to)); !strings.Contains(message, "<p>one<p>two</p></p>") {
+		t.Errorf("malformed HTML not repaired:\n%s", message)
+	}
+	if _, err := createEmailMessage("Unsafe", "", "<p>hi</p><script>alert(1)</script>", "", to, messageOptions{}); err == nil {
+		t.Error("sanitizer error ignored")
+	}
+
+	emailConfig.RejectMalformedHTML = true
+	if _, err := createEmailMessage("Rejected", "", malformed, "", to, messageOptions{}); err == nil {
+		t.Error("malformed HTML accepted with RejectMalformedHTML")
+	}
+	composeMessage(t, "Well-formed", "", "<p>one</p>", "", to)
+}
@@ -0,0 +1,88 @@
+package gosmtpmail
+
+import "sync"
+
+// defaultIdempotencyStoreSize bounds the number of keys kept by the default store
+const defaultIdempotencyStoreSize = 10000
+
+// IdempotencyStore remembers idempotency keys of sent messages. A send
+// reserves its key first and then completes or releases the reservation, so a
+// concurrent duplicate is only skipped once the first send succeeded.
+type IdempotencyStore interface {
+	// Reserve claims key for a send, returning ErrDuplicateSend when it was
+	// already sent. It may block while another send holds the reservation.
+	Reserve(key string) error
+	// Complete records that the send holding the reservation for key succeeded
+	Complete(key string)
+	// Release drops the reservation for key after a failed send so it can be retried
+	Release(key string)
+}
+
+// memoryIdempotencyStore is a size-bounded in-memory IdempotencyStore that
+// evicts the oldest sent keys first
+type memoryIdempotencyStore struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	size int
+	// sent is true for sent keys and false for keys reserved by an ongoing send
+	sent  map[string]bool
+	order []string
+}
+
+var defaultIdempotencyStore = NewMemoryIdempotencyStore(defaultIdempotencyStoreSize)
+
+// NewMemoryIdempotencyStore returns an in-memory IdempotencyStore holding at most size sent keys
+func NewMemoryIdempotencyStore(size int) IdempotencyStore {
+	s := &memoryIdempotencyStore{size: size, sent: make(map[string]bool)}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *memoryIdempotencyStore) Reserve(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		sent, ok := s.sent[key]
+		if !ok {
+			s.sent[key] = false
+			return nil
+		}
+		if sent {
+			return ErrDuplicateSend
+		}
+		// Wait for the ongoing send to complete or release the key
+		s.cond.Wait()
+	}
+}
+
+func (s *memoryIdempotencyStore) Complete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.cond.Broadcast()
+
+	if s.size > 0 && len(s.order) >= s.size {
+		delete(s.sent, s.order[0])
+		s.order = s.order[1:]
+	}
+	s.sent[key] = true
+	s.order = append(s.order, key)
+}
+
+func (s *memoryIdempotencyStore) Release(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.cond.Broadcast()
+
+	if sent, ok := s.sent[key]; ok && !sent {
+		delete(s.sent, key)
+	}
+}
+
+// idempotencyStore returns the configured store or the default one
+func idempotencyStore() IdempotencyStore {
+	if emailConfig.IdempotencyStore != nil {
+		return emailConfig.IdempotencyStore
+	}
+	return defaultIdempotencyStore
+}
@@ -0,0 +1,102 @@
+package gosmtpmail
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKeyRepeated(t *testing.T) {
+	server := newFakeServer(t)
+	var reported []error
+	config := serverConfig(server)
+	config.OnError = func(subject string, to []string, err error) { reported = append(reported, err) }
+	useConfig(t, config)
+
+	to := []string{"jane@example.com"}
+	if err := Send("Invoice", "body", "", "", to, WithIdempotencyKey("invoice-42")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Send("Invoice", "body", "", "", to, WithIdempotencyKey("invoice-42")); !errors.Is(err, ErrDuplicateSend) {
+		t.Errorf("repeated send returned %v, want ErrDuplicateSend", err)
+	}
+	if ok, err := EmailSenderE("Invoice", "body", "", "", to, WithIdempotencyKey("invoice-42")); !ok || !errors.Is(err, ErrDuplicateSend) {
+		t.Errorf("EmailSenderE = %v, %v, want true, ErrDuplicateSend", ok, err)
+	}
+	if !EmailSender("Invoice", "body", "", "", to, WithIdempotencyKey("invoice-42")) {
+		t.Error("EmailSender reported a duplicate as not sent")
+	}
+
+	if got := len(server.Messages()); got != 1 {
+		t.Errorf("got %d messages, want 1", got)
+	}
+	if len(reported) != 0 {
+		t.Errorf("OnError called for duplicates: %v", reported)
+	}
+}
+
+func TestIdempotencyKeyRetriedAfterFailure(t *testing.T) {
+	server := newFakeServer(t, func(s *fakeServer) {
+		s.replies = map[string]string{"MAIL FROM:<fail@": "451 4.3.0 try again later"}
+	})
+	config := serverConfig(server)
+	config.EmailAddress = "fail@example.com"
+	useConfig(t, config)
+	if err := Send("Invoice", "body", "", "", []string{"jane@example.com"}, WithIdempotencyKey("invoice-43")); err == nil {
+		t.Fatal("send succeeded despite the rejected sender")
+	}
+
+	emailConfig.EmailAddress = "sender@example.com"
+	if err := Send("Invoice", "body", "", "", []string{"jane@example.com"}, WithIdempotencyKey("invoice-43")); err != nil {
+		t.Fatalf("retry after a failed send: %v", err)
+	}
+}
+
+func TestMemoryIdempotencyStoreConcurrentDuplicate(t *testing.T) {
+	store := NewMemoryIdempotencyStore(10)
+	if err := store.Reserve("key"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A concurrent duplicate waits for the first send instead of being skipped
+	var wg sync.WaitGroup
+	results := make(chan error, 1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results <- store.Reserve("key")
+	}()
+	select {
+	case err := <-results:
+		t.Fatalf("duplicate reserved while the first send was in flight: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The first send fails, so the duplicate gets to send
+	store.Release("key")
+	wg.Wait()
+	if err := <-results; err != nil {
+		t.Fatalf("duplicate not allowed to send after the first one failed: %v", err)
+	}
+	store.Complete("key")
+	if err := store.Reserve("key"); !errors.Is(err, ErrDuplicateSend) {
+		t.Errorf("Reserve after Complete = %v, want ErrDuplicateSend", err)
+	}
+}
+
+func TestMemoryIdempotencyStoreBounded(t *testing.T) {
+	store := NewMemoryIdempotencyStore(2)
+	for _, key := range []string{"a", "b", "c"} {
+		if err := store.Reserve(key); err != nil {
+			t.Fatal(err)
+		}
+		store.Complete(key)
+	}
+	if err := store.Reserve("a"); err != nil {
+		t.Errorf("oldest key not evicted: %v", err)
+	}
+	if err := store.Reserve("c"); !errors.Is(err, ErrDuplicateSend) {
+		t.Errorf("newest key evicted: %v", err)
+	}
+}
@@ -0,0 +1,36 @@
+package gosmtpmail
+
+import (
+	"fmt"
+	"github.com/mehmetdenizer/gohelpers"
+	"time"
+)
+
+// SendFunc delivers a composed message to the envelope recipients. msg is nil
+// when the message is streamed: always with EmailConfig.StreamAttachments, and
+// otherwise when the attachment is larger than EmailConfig.StreamThresholdBytes
+// (5 MB by default). Middleware must pass a nil msg on to next unchanged. A
+// middleware may call next more than once, e.g. to retry; a streamed message is
+// then read and sent again in full.
+type SendFunc func(from string, to []string, msg []byte) error
+
+// SendMiddleware wraps a SendFunc with additional behavior
+type SendMiddleware func(next SendFunc) SendFunc
+
+// chainMiddleware wraps send with middleware so the first one runs outermost
+func chainMiddleware(send SendFunc, middleware []SendMiddleware) SendFunc {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		send = middleware[i](send)
+	}
+	return send
+}
+
+// TimingMiddleware logs how long each send took
+func TimingMiddleware(next SendFunc) SendFunc {
+	return func(from string, to []string, msg []byte) error {
+		start := time.Now()
+		err := next(from, to, msg)
+		gohelpers.LogInfo(fmt.Sprintf("Email to %d recipient(s) took %s", len(to), time.Since(start)))
+		return err
+	}
+}
@@ -0,0 +1,73 @@
+package gosmtpmail
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMiddlewareOrder(t *testing.T) {
+	server := newFakeServer(t)
+	config := serverConfig(server)
+	var calls []string
+	trace := func(name string) SendMiddleware {
+		return func(next SendFunc) SendFunc {
+			return func(from string, to []string, msg []byte) error {
+				calls = append(calls, name+" before")
+				err := next(from, to, msg)
+				calls = append(calls, name+" after")
+				return err
+			}
+		}
+	}
+	config.Middleware = []SendMiddleware{trace("first"), trace("second"), trace("third")}
+	useConfig(t, config)
+
+	if err := Send("Ordered", "body", "", "", []string{"jane@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"first before", "second before", "third before", "third after", "second after", "first after"}
+	if !slices.Equal(calls, want) {
+		t.Errorf("middleware calls = %q, want %q", calls, want)
+	}
+	if len(server.Messages()) != 1 {
+		t.Errorf("server received %d messages, want 1", len(server.Messages()))
+	}
+}
+
+func TestTimingMiddleware(t *testing.T) {
+	server := newFakeServer(t, func(s *fakeServer) {
+		s.replies = map[string]string{"RCPT TO:<bounce@": "550 5.1.1 no such user"}
+	})
+	config := serverConfig(server)
+	config.Middleware = []SendMiddleware{TimingMiddleware}
+	useConfig(t, config)
+
+	// gohelpers appends info messages to a monthly log file
+	now := time.Now()
+	logFile := filepath.Join("storage", "logs", "info", fmt.Sprintf("%d-%02d_info.log", now.Year(), int(now.Month())))
+	before, _ := os.ReadFile(logFile)
+
+	if err := Send("Timed", "body", "", "", []string{"jane@example.com", "john@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.Messages()) != 1 {
+		t.Errorf("server received %d messages, want 1", len(server.Messages()))
+	}
+	after, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logged := string(after[len(before):]); !strings.Contains(logged, "Email to 2 recipient(s) took ") {
+		t.Errorf("send duration not logged, got %q", logged)
+	}
+
+	// The error of the wrapped send is returned unchanged
+	if err := Send("Bounced", "body", "", "", []string{"bounce@example.com"}); err == nil || !strings.Contains(err.Error(), "550") {
+		t.Errorf("TimingMiddleware returned %v, want the rejection", err)
+	}
+}
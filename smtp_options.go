@@ -0,0 +1,220 @@
+package gosmtpmail
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// MessageClass selects a bundle of deliverability defaults for a message
+type MessageClass int
+
+const (
+	// ClassTransactional is for one-to-one mail triggered by the recipient; it adds no bulk headers
+	ClassTransactional MessageClass = iota
+	// ClassBulk adds Precedence: bulk and Auto-Submitted: auto-generated and requires List-Unsubscribe
+	ClassBulk
+)
+
+// MessageOption customizes a single send
+type MessageOption func(*messageOptions)
+
+// messageOptions holds the per-message settings applied by MessageOption
+type messageOptions struct {
+	heloName       string
+	idempotencyKey string
+	comments       string
+	keywords       []string
+	bodyType       string
+	mailFromParams map[string]string
+	charset        string
+	sensitivity    string
+	archivedAt     string
+	tenant         string
+	class          MessageClass
+	unsubscribe    []string
+	attachmentHash string
+	skipped        *[]string
+	listID         string
+	listName       string
+
+	prependedHeaders []string
+	extraHeaders     [][2]string
+
+	// sevenBit encodes non-ASCII text parts as quoted-printable
+	sevenBit bool
+}
+
+// newMessageOptions applies opts over the defaults
+func newMessageOptions(opts []MessageOption) messageOptions {
+	var options messageOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+// WithHeloName overrides EmailConfig.LocalName as the EHLO/HELO name for this message
+func WithHeloName(name string) MessageOption {
+	return func(o *messageOptions) {
+		o.heloName = name
+	}
+}
+
+// WithIdempotencyKey skips the send with ErrDuplicateSend when a message with the same key was already sent
+func WithIdempotencyKey(key string) MessageOption {
+	return func(o *messageOptions) {
+		o.idempotencyKey = key
+	}
+}
+
+// WithComments adds a Comments header to the message
+func WithComments(comments string) MessageOption {
+	return func(o *messageOptions) {
+		o.comments = comments
+	}
+}
+
+// WithKeywords adds a Keywords header listing the keywords
+func WithKeywords(keywords ...string) MessageOption {
+	return func(o *messageOptions) {
+		o.keywords = keywords
+	}
+}
+
+// WithBodyContentType sends body with this Content-Type, e.g.
+// "application/json", instead of text/plain. Without an attachment the message
+// isn't multipart and the type is the top-level Content-Type.
+func WithBodyContentType(contentType string) MessageOption {
+	return func(o *messageOptions) {
+		o.bodyType = contentType
+	}
+}
+
+// WithMailFromParams adds ESMTP MAIL FROM parameters, overriding EmailConfig.MailFromParams with the same keyword
+func WithMailFromParams(params map[string]string) MessageOption {
+	return func(o *messageOptions) {
+		o.mailFromParams = params
+	}
+}
+
+// WithCharset overrides EmailConfig.Charset for this message
+func WithCharset(charset string) MessageOption {
+	return func(o *messageOptions) {
+		o.charset = charset
+	}
+}
+
+// WithSensitivity adds a Sensitivity header ("Personal", "Private" or "Company-Confidential")
+func WithSensitivity(sensitivity string) MessageOption {
+	return func(o *messageOptions) {
+		o.sensitivity = sensitivity
+	}
+}
+
+// WithArchivedAt adds an Archived-At header pointing at the archived copy of the message
+func WithArchivedAt(archiveURL string) MessageOption {
+	return func(o *messageOptions) {
+		o.archivedAt = archiveURL
+	}
+}
+
+// WithTenant identifies the tenant whose EmailConfig.QuotaStore quota the send counts against
+func WithTenant(tenant string) MessageOption {
+	return func(o *messageOptions) {
+		o.tenant = tenant
+	}
+}
+
+// WithListID adds a List-ID header, e.g. WithListID("Community news", "news.example.com")
+func WithListID(description, id string) MessageOption {
+	return func(o *messageOptions) {
+		o.listName = description
+		o.listID = id
+	}
+}
+
+// WithHeader adds a custom header after the standard ones. It can be given
+// several times, also with the same name, and headers keep their order.
+func WithHeader(name, value string) MessageOption {
+	return func(o *messageOptions) {
+		o.extraHeaders = append(o.extraHeaders, [2]string{name, value})
+	}
+}
+
+// WithPrependedHeaders adds raw "Name: value" header lines, which may be folded,
+// before the standard headers, e.g. Authentication-Results or ARC-* headers
+func WithPrependedHeaders(lines ...string) MessageOption {
+	return func(o *messageOptions) {
+		o.prependedHeaders = append(o.prependedHeaders, lines...)
+	}
+}
+
+// WithClass applies the header profile of class to the message
+func WithClass(class MessageClass) MessageOption {
+	return func(o *messageOptions) {
+		o.class = class
+	}
+}
+
+// WithListUnsubscribe adds a List-Unsubscribe header with the given mailto: or https: URIs
+func WithListUnsubscribe(uris ...string) MessageOption {
+	return func(o *messageOptions) {
+		o.unsubscribe = append(o.unsubscribe, uris...)
+	}
+}
+
+// WithAttachmentSHA256 verifies the attachment against the hex-encoded SHA-256
+// checksum before it is sent
+func WithAttachmentSHA256(checksum string) MessageOption {
+	return func(o *messageOptions) {
+		o.attachmentHash = checksum
+	}
+}
+
+// WithSkippedAttachments appends to skipped the attachment paths that
+// EmailConfig.SkipMissingAttachments left out of the message
+func WithSkippedAttachments(skipped *[]string) MessageOption {
+	return func(o *messageOptions) {
+		o.skipped = skipped
+	}
+}
+
+// validateHostname checks that name is a valid hostname or address literal
+func validateHostname(name string) error {
+	if strings.HasPrefix(name, "[") {
+		if !isAddressLiteral(name) {
+			return errors.New("invalid address literal: " + name)
+		}
+		return nil
+	}
+	if name == "" || len(name) > 253 {
+		return errors.New("invalid hostname: " + name)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return errors.New("invalid hostname: " + name)
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return errors.New("invalid hostname: " + name)
+			}
+		}
+	}
+	return nil
+}
+
+// isAddressLiteral reports whether name is an RFC 5321 address literal,
+// "[" IPv4 address "]" or "[IPv6:" IPv6 address "]"
+func isAddressLiteral(name string) bool {
+	if !strings.HasPrefix(name, "[") || !strings.HasSuffix(name, "]") {
+		return false
+	}
+	literal := name[1 : len(name)-1]
+	if ipv6, ok := strings.CutPrefix(literal, "IPv6:"); ok {
+		ip := net.ParseIP(ipv6)
+		return ip != nil && strings.Contains(ipv6, ":")
+	}
+	ip := net.ParseIP(literal)
+	return ip != nil && ip.To4() != nil && !strings.Contains(literal, ":")
+}
@@ -0,0 +1,243 @@
+package gosmtpmail
+
+import (
+	"io"
+	"mime"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestWithHeloName(t *testing.T) {
+	server := newFakeServer(t)
+	config := serverConfig(server)
+	config.LocalName = "mail.example.com"
+	useConfig(t, config)
+
+	if err := Send("Default", "body", "", "", []string{"jane@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Send("Override", "body", "", "", []string{"jane@example.com"}, WithHeloName("mx2.example.org")); err != nil {
+		t.Fatal(err)
+	}
+
+	var helos []string
+	for _, command := range server.Commands() {
+		if name, ok := strings.CutPrefix(command, "EHLO "); ok {
+			helos = append(helos, name)
+		}
+	}
+	if len(helos) != 2 || helos[0] != "mail.example.com" || helos[1] != "mx2.example.org" {
+		t.Errorf("EHLO names = %q, want [mail.example.com mx2.example.org]", helos)
+	}
+}
+
+func TestWithHeloNameRejectsInvalidHostname(t *testing.T) {
+	server := newFakeServer(t)
+	useConfig(t, serverConfig(server))
+
+	for _, name := range []string{"bad name", "[1.2.3.4]\r\nRSET\r\nX: [x]", "[999.1.1.1]", "[anything]"} {
+		if err := Send("Invalid", "body", "", "", []string{"jane@example.com"}, WithHeloName(name)); err == nil {
+			t.Errorf("invalid HELO name %q accepted", name)
+		}
+	}
+	if server.Connections() != 0 {
+		t.Error("connected despite the invalid HELO name")
+	}
+}
+
+func TestWithSensitivity(t *testing.T) {
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com"})
+	to := []string{"jane@example.com"}
+
+	msg := parseMessage(t, composeMessage(t, "Notice", "body", "", "", to, WithSensitivity("Company-Confidential")))
+	if got := msg.Header.Get("Sensitivity"); got != "Company-Confidential" {
+		t.Errorf("Sensitivity = %q, want Company-Confidential", got)
+	}
+	msg = parseMessage(t, composeMessage(t, "Notice", "body", "", "", to))
+	if _, ok := msg.Header["Sensitivity"]; ok {
+		t.Error("Sensitivity emitted by default")
+	}
+	if _, err := createEmailMessage("Notice", "body", "", "", to, newMessageOptions([]MessageOption{WithSensitivity("Secret")})); err == nil {
+		t.Error("invalid Sensitivity value accepted")
+	}
+}
+
+func TestWithArchivedAt(t *testing.T) {
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com"})
+	to := []string{"jane@example.com"}
+
+	msg := parseMessage(t, composeMessage(t, "Archived", "body", "", "", to, WithArchivedAt("https://archive.example.com/msg/42")))
+	if got := msg.Header.Get("Archived-At"); got != "<https://archive.example.com/msg/42>" {
+		t.Errorf("Archived-At = %q, want the bracketed URL", got)
+	}
+	for _, invalid := range []string{"not a url", "https://archive.example.com/>\r\nBcc: x@example.com"} {
+		if _, err := createEmailMessage("Archived", "body", "", "", to, newMessageOptions([]MessageOption{WithArchivedAt(invalid)})); err == nil {
+			t.Errorf("invalid Archived-At URL %q accepted", invalid)
+		}
+	}
+}
+
+func TestWithPrependedHeaders(t *testing.T) {
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com"})
+	to := []string{"jane@example.com"}
+	arc := "ARC-Seal: i=1; a=rsa-sha256; cv=none; d=example.com; s=arc;\r\n b=dGVzdA=="
+
+	message := string(composeMessage(t, "Sealed", "body", "", "", to,
+		WithPrependedHeaders("Authentication-Results: mx.example.com; spf=pass", arc)))
+	if !strings.HasPrefix(message, "Authentication-Results: mx.example.com; spf=pass\r\n"+arc+"\r\nMIME-Version: 1.0\r\n") {
+		t.Errorf("prepended headers aren't before the standard headers:\n%s", message)
+	}
+	msg := parseMessage(t, []byte(message))
+	if msg.Header.Get("ARC-Seal") == "" || msg.Header.Get("Subject") != "Sealed" {
+		t.Errorf("message with prepended headers doesn't parse as expected:\n%s", message)
+	}
+
+	for _, line := range []string{"no colon", "Bad Name: value", "X-Injected: value\r\n\r\nbody", "X-Bare: value\nX-Other: value"} {
+		if _, err := createEmailMessage("Sealed", "body", "", "", to, newMessageOptions([]MessageOption{WithPrependedHeaders(line)})); err == nil {
+			t.Errorf("malformed header line %q accepted", line)
+		}
+	}
+}
+
+func TestWithClass(t *testing.T) {
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com"})
+	to := []string{"jane@example.com"}
+	unsubscribe := WithListUnsubscribe("mailto:unsubscribe@example.com")
+
+	bulk := parseMessage(t, composeMessage(t, "News", "body", "", "", to, WithClass(ClassBulk), unsubscribe))
+	for name, want := range map[string]string{
+		"Precedence":       "bulk",
+		"Auto-Submitted":   "auto-generated",
+		"List-Unsubscribe": "<mailto:unsubscribe@example.com>",
+	} {
+		if got := bulk.Header.Get(name); got != want {
+			t.Errorf("bulk %s = %q, want %q", name, got, want)
+		}
+	}
+
+	transactional := parseMessage(t, composeMessage(t, "Receipt", "body", "", "", to, WithClass(ClassTransactional)))
+	for _, name := range []string{"Precedence", "Auto-Submitted", "List-Unsubscribe"} {
+		if got := transactional.Header.Get(name); got != "" {
+			t.Errorf("transactional message has %s: %q", name, got)
+		}
+	}
+
+	if _, err := createEmailMessage("News", "body", "", "", to, newMessageOptions([]MessageOption{WithClass(ClassBulk)})); err == nil {
+		t.Error("bulk message without List-Unsubscribe accepted")
+	}
+}
+
+func TestWithHeader(t *testing.T) {
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com"})
+	to := []string{"jane@example.com"}
+
+	message := composeMessage(t, "Tagged", "body", "", "", to, WithHeader("X-Tag", "first"), WithHeader("X-Tag", "second"))
+	if got := parseMessage(t, message).Header["X-Tag"]; len(got) != 2 || got[0] != "first" || got[1] != "second" {
+		t.Errorf("X-Tag = %q, want both headers in order", got)
+	}
+
+	for _, name := range []string{"Subject", "bcc", "Message-ID", "content-type"} {
+		if _, err := createEmailMessage("Tagged", "body", "", "", to, newMessageOptions([]MessageOption{WithHeader(name, "value")})); err == nil {
+			t.Errorf("reserved header %s accepted", name)
+		}
+	}
+}
+
+func TestWithListID(t *testing.T) {
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com"})
+	to := []string{"jane@example.com"}
+
+	tests := []struct {
+		description, id, want string
+	}{
+		{"Community news", "news.example.com", "List-ID: Community news <news.example.com>\r\n"},
+		{"", "news.example.com", "List-ID: <news.example.com>\r\n"},
+		{"News, weekly", "weekly.news.example.com", "List-ID: \"News, weekly\" <weekly.news.example.com>\r\n"},
+	}
+	for _, tt := range tests {
+		message := string(composeMessage(t, "News", "body", "", "", to, WithListID(tt.description, tt.id), WithListUnsubscribe("https://example.com/unsubscribe")))
+		if !strings.Contains(message, tt.want) {
+			t.Errorf("WithListID(%q, %q) didn't emit %q:\n%s", tt.description, tt.id, tt.want, message)
+		}
+	}
+
+	for _, id := range []string{"news", "news@example.com", "news..example.com", "news example.com"} {
+		if _, err := createEmailMessage("News", "body", "", "", to, newMessageOptions([]MessageOption{WithListID("News", id)})); err == nil {
+			t.Errorf("invalid list-id %q accepted", id)
+		}
+	}
+}
+
+func TestWithKeywords(t *testing.T) {
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com"})
+	to := []string{"jane@example.com"}
+
+	var keywords []string
+	for i := 0; i < 12; i++ {
+		keywords = append(keywords, "invoice-"+strings.Repeat("x", i))
+	}
+	keywords = append(keywords, "Rechnung für März", "v1.2")
+	message := string(composeMessage(t, "Tagged", "body", "", "", to, WithKeywords(keywords...)))
+
+	header := regexp.MustCompile(`Keywords: .*\r\n( .*\r\n)*`).FindString(message)
+	if header == "" {
+		t.Fatalf("no Keywords header:\n%s", message)
+	}
+	lines := strings.Split(strings.TrimSuffix(header, "\r\n"), "\r\n")
+	if len(lines) < 2 {
+		t.Errorf("long Keywords header not folded: %q", header)
+	}
+	for _, line := range lines {
+		if len(line) > 78 {
+			t.Errorf("Keywords line longer than 78 characters: %q", line)
+		}
+	}
+
+	msg := parseMessage(t, []byte(message))
+	decoded, err := (&mime.WordDecoder{}).DecodeHeader(msg.Header.Get("Keywords"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join(keywords[:12], ", ") + ", Rechnung für März, \"v1.2\""
+	if decoded != want {
+		t.Errorf("Keywords = %q, want %q", decoded, want)
+	}
+
+	if message := string(composeMessage(t, "Untagged", "body", "", "", to)); strings.Contains(message, "Keywords:") {
+		t.Error("Keywords emitted by default")
+	}
+}
+
+func TestWithBodyContentType(t *testing.T) {
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com"})
+	to := []string{"jane@example.com"}
+
+	message := composeMessage(t, "Report", `{"status":"ok"}`, "", "", to, WithBodyContentType("application/json; charset=utf-8"))
+	msg := parseMessage(t, message)
+	if got := msg.Header.Get("Content-Type"); got != "application/json; charset=utf-8" {
+		t.Errorf("top-level Content-Type = %q, want application/json; charset=utf-8", got)
+	}
+	if got := msg.Header.Get("Content-Transfer-Encoding"); got != "7bit" {
+		t.Errorf("Content-Transfer-Encoding = %q, want 7bit", got)
+	}
+	if body, err := io.ReadAll(msg.Body); err != nil || string(body) != `{"status":"ok"}` {
+		t.Errorf("body = %q, %v, want the JSON as is", body, err)
+	}
+
+	// With an attachment the custom part is wrapped in multipart/mixed
+	_, path := writeAttachment(t, "report.pdf", []byte("%PDF-1.4"))
+	types := partTypes(t, composeMessage(t, "Report", `{"status":"ok"}`, "", path, to, WithBodyContentType("application/json")))
+	if len(types) != 2 || types[0] != "application/json" {
+		t.Errorf("parts = %q, want the application/json part and the attachment", types)
+	}
+
+	for _, contentType := range []string{"json", "application/json; charset", "multipart/mixed", "text/plain\r\nX-Injected: yes"} {
+		if _, err := createEmailMessage("Report", "{}", "", "", to, newMessageOptions([]MessageOption{WithBodyContentType(contentType)})); err == nil {
+			t.Errorf("invalid Content-Type %q accepted", contentType)
+		}
+	}
+	if _, err := createEmailMessage("Report", "{}", "<p>html</p>", "", to, newMessageOptions([]MessageOption{WithBodyContentType("application/json")})); err == nil {
+		t.Error("custom Content-Type combined with an HTML body accepted")
+	}
+}
@@ -0,0 +1,53 @@
+package gosmtpmail
+
+import (
+	"sync"
+	"time"
+)
+
+// QuotaStore decides whether a tenant may send another email
+type QuotaStore interface {
+	// Allow reports whether tenant is within its quota, counting the send if so
+	Allow(tenant string) (bool, error)
+	// Refund gives back a send counted by Allow that then failed
+	Refund(tenant string)
+}
+
+// dailyQuotaStore is an in-memory QuotaStore that resets every day at midnight UTC
+type dailyQuotaStore struct {
+	mu     sync.Mutex
+	limit  int
+	day    string
+	counts map[string]int
+}
+
+// NewDailyQuotaStore returns an in-memory QuotaStore allowing limit emails per tenant per day
+func NewDailyQuotaStore(limit int) QuotaStore {
+	return &dailyQuotaStore{limit: limit, counts: make(map[string]int)}
+}
+
+func (s *dailyQuotaStore) Allow(tenant string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	today := time.Now().UTC().Format(time.DateOnly)
+	if today != s.day {
+		s.day = today
+		s.counts = make(map[string]int)
+	}
+	if s.counts[tenant] >= s.limit {
+		return false, nil
+	}
+	s.counts[tenant]++
+	return true, nil
+}
+
+func (s *dailyQuotaStore) Refund(tenant string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// A send from before the daily reset was already forgotten
+	if time.Now().UTC().Format(time.DateOnly) == s.day && s.counts[tenant] > 0 {
+		s.counts[tenant]--
+	}
+}
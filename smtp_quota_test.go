@@ -0,0 +1,56 @@
+package gosmtpmail
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestQuotaExhausted(t *testing.T) {
+	server := newFakeServer(t)
+	config := serverConfig(server)
+	config.QuotaStore = NewDailyQuotaStore(2)
+	useConfig(t, config)
+
+	to := []string{"jane@example.com"}
+	for i := 0; i < 2; i++ {
+		if err := Send("Within quota", "body", "", "", to, WithTenant("acme")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	connections := server.Connections()
+	if err := Send("Over quota", "body", "", "", to, WithTenant("acme")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("third send returned %v, want ErrQuotaExceeded", err)
+	}
+	if server.Connections() != connections {
+		t.Error("server contacted for a send over the quota")
+	}
+	if err := Send("Other tenant", "body", "", "", to, WithTenant("globex")); err != nil {
+		t.Errorf("other tenant limited by acme's quota: %v", err)
+	}
+}
+
+func TestQuotaRefundedOnFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com", Host: host, Port: port, TLSMode: TLSModeNone, QuotaStore: NewDailyQuotaStore(1)})
+
+	to := []string{"jane@example.com"}
+	if err := Send("Refused", "body", "", "", to, WithTenant("acme")); err == nil || errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("send to a refused port returned %v, want a connect error", err)
+	}
+
+	// The failed send doesn't count, so the tenant can still send once
+	server := newFakeServer(t)
+	emailConfig.Host, emailConfig.Port = server.hostPort()
+	if err := Send("Retry", "body", "", "", to, WithTenant("acme")); err != nil {
+		t.Fatalf("retry after a refused connection: %v", err)
+	}
+	if err := Send("Over quota", "body", "", "", to, WithTenant("acme")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("second successful send returned %v, want ErrQuotaExceeded", err)
+	}
+}
@@ -0,0 +1,48 @@
+package gosmtpmail
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// ReceivedHeader returns an RFC 5321 Received header line documenting a relay
+// hop, for prepending to a forwarded message. id and with are optional.
+func ReceivedHeader(from, by, with, id string, date time.Time) (string, error) {
+	if err := validateHostname(from); err != nil {
+		return "", errors.New("invalid Received from: " + from)
+	}
+	if err := validateHostname(by); err != nil {
+		return "", errors.New("invalid Received by: " + by)
+	}
+	if with != "" && !isAtom(with) {
+		return "", errors.New("invalid Received with: " + with)
+	}
+	if id != "" && !isAtom(strings.TrimSuffix(strings.TrimPrefix(id, "<"), ">")) {
+		return "", errors.New("invalid Received id: " + id)
+	}
+
+	clauses := []string{"from " + from, "by " + by}
+	if with != "" {
+		clauses = append(clauses, "with "+with)
+	}
+	if id != "" {
+		clauses = append(clauses, "id "+id)
+	}
+	return foldHeader("Received: " + strings.Join(clauses, " ") + "; " + date.Format(time.RFC1123Z)), nil
+}
+
+// isAtom reports whether s is a non-empty run of printable, non-special ASCII
+// characters ('@' and '.' are allowed)
+func isAtom(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c > '~' || strings.IndexByte("()<>[]:;,\\\"", c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
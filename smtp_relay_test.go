@@ -0,0 +1,49 @@
+package gosmtpmail
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReceivedHeader(t *testing.T) {
+	date := time.Date(2026, time.March, 4, 15, 30, 0, 0, time.FixedZone("", 3*60*60))
+
+	got, err := ReceivedHeader("client.example.com", "relay.example.net", "ESMTPS", "<4f2a@relay.example.net>", date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Received: from client.example.com by relay.example.net with ESMTPS id\r\n <4f2a@relay.example.net>; Wed, 04 Mar 2026 15:30:00 +0300"
+	if got != want {
+		t.Errorf("ReceivedHeader =\n%q, want\n%q", got, want)
+	}
+
+	got, err = ReceivedHeader("[192.0.2.1]", "relay.example.net", "", "", date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Lines over 78 characters are folded
+	if want := "Received: from [192.0.2.1] by relay.example.net; Wed, 04 Mar 2026 15:30:00\r\n +0300"; got != want {
+		t.Errorf("ReceivedHeader = %q, want %q", got, want)
+	}
+
+	if _, err := ReceivedHeader("[IPv6:2001:db8::1]", "relay.example.net", "", "", date); err != nil {
+		t.Errorf("IPv6 address literal rejected: %v", err)
+	}
+
+	for _, args := range [][4]string{
+		{"bad host", "relay.example.net", "", ""},
+		{"[1.2.3.4]\r\nBcc: victim@example.com\r\nX-A: [x]", "relay.example.net", "", ""},
+		{"[1.2.3.4]\nBcc: victim@example.com]", "relay.example.net", "", ""},
+		{"[not an address]", "relay.example.net", "", ""},
+		{"[2001:db8::1]", "relay.example.net", "", ""},
+		{"[IPv6:1.2.3.4]", "relay.example.net", "", ""},
+		{"[]", "relay.example.net", "", ""},
+		{"client.example.com", "[1.2.3.4]\r\nBcc: victim@example.com\r\nX-A: [x]", "", ""},
+		{"client.example.com", "relay.example.net", "ESMTP\r\nBcc:", ""},
+		{"client.example.com", "relay.example.net", "", "<id with space>"},
+	} {
+		if _, err := ReceivedHeader(args[0], args[1], args[2], args[3], date); err == nil {
+			t.Errorf("ReceivedHeader(%q) accepted", args)
+		}
+	}
+}
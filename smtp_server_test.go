@@ -0,0 +1,378 @@
+package gosmtpmail
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer is an in-process SMTP server that records what clients send
+type fakeServer struct {
+	listener net.Listener
+	closed   chan struct{}
+
+	// extensions are advertised in the EHLO response
+	extensions []string
+	// replies overrides the reply to commands starting with a prefix, e.g. "RCPT TO:<bad"
+	replies map[string]string
+	// tlsConfig enables STARTTLS, or implicit TLS when implicitTLS is set
+	tlsConfig   *tls.Config
+	implicitTLS bool
+	// password is checked for CRAM-MD5
+	password string
+	// stallData stops reading once DATA is accepted
+	stallData bool
+	// discardData reads DATA payloads without recording them
+	discardData bool
+
+	mu          sync.Mutex
+	commands    []string
+	messages    []string
+	auths       []string
+	connections int
+}
+
+// newFakeServer starts a fake server, applying configure before it accepts connections
+func newFakeServer(t testing.TB, configure ...func(*fakeServer)) *fakeServer {
+	t.Helper()
+	s := &fakeServer{
+		closed:     make(chan struct{}),
+		extensions: []string{"8BITMIME", "AUTH PLAIN"},
+		password:   "secret",
+	}
+	for _, c := range configure {
+		c(s)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.implicitTLS {
+		listener = tls.NewListener(listener, s.tlsConfig)
+	}
+	s.listener = listener
+	t.Cleanup(s.close)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) close() {
+	select {
+	case <-s.closed:
+	default:
+		close(s.closed)
+		s.listener.Close()
+	}
+}
+
+// hostPort returns the host and port the server listens on
+func (s *fakeServer) hostPort() (string, string) {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return host, port
+}
+
+func (s *fakeServer) record(list *[]string, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	*list = append(*list, value)
+}
+
+// Commands returns the command lines received so far
+func (s *fakeServer) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.commands...)
+}
+
+// Messages returns the DATA payloads received so far, with CRLF line endings
+func (s *fakeServer) Messages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.messages...)
+}
+
+// Auths returns the decoded credentials of each AUTH exchange
+func (s *fakeServer) Auths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.auths...)
+}
+
+// Connections returns the number of accepted connections
+func (s *fakeServer) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connections
+}
+
+// command returns the first received command starting with prefix
+func (s *fakeServer) command(prefix string) string {
+	for _, command := range s.Commands() {
+		if strings.HasPrefix(command, prefix) {
+			return command
+		}
+	}
+	return ""
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	s.mu.Lock()
+	s.connections++
+	s.mu.Unlock()
+
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 fake.test ESMTP")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		s.record(&s.commands, line)
+
+		if reply, ok := s.override(line); ok {
+			text.PrintfLine("%s", reply)
+			continue
+		}
+		verb, _, _ := strings.Cut(strings.ToUpper(line), " ")
+		switch verb {
+		case "EHLO":
+			extensions := s.extensions
+			if s.tlsConfig != nil && !s.implicitTLS {
+				if _, isTLS := conn.(*tls.Conn); !isTLS {
+					extensions = append(extensions, "STARTTLS")
+				}
+			}
+			text.PrintfLine("250-fake.test")
+			for _, extension := range extensions {
+				text.PrintfLine("250-%s", extension)
+			}
+			text.PrintfLine("250 HELP")
+		case "STARTTLS":
+			text.PrintfLine("220 ready to start TLS")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+			text = textproto.NewConn(conn)
+		case "AUTH":
+			s.auth(text, line)
+		case "DATA":
+			text.PrintfLine("354 end data with <CR><LF>.<CR><LF>")
+			if s.stallData {
+				<-s.closed
+				return
+			}
+			data, err := readData(text.R)
+			if err != nil {
+				return
+			}
+			if !s.discardData {
+				s.record(&s.messages, data)
+			}
+			text.PrintfLine("250 2.0.0 queued")
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("250 OK")
+		}
+	}
+}
+
+// override returns the configured reply for line
+func (s *fakeServer) override(line string) (string, bool) {
+	for prefix, reply := range s.replies {
+		if strings.HasPrefix(line, prefix) {
+			return reply, true
+		}
+	}
+	return "", false
+}
+
+// auth runs an AUTH exchange for PLAIN, LOGIN or CRAM-MD5
+func (s *fakeServer) auth(text *textproto.Conn, line string) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		text.PrintfLine("501 syntax error")
+		return
+	}
+	readLine := func() string {
+		response, _ := text.ReadLine()
+		decoded, _ := base64.StdEncoding.DecodeString(response)
+		return string(decoded)
+	}
+	switch strings.ToUpper(fields[1]) {
+	case "PLAIN":
+		var credentials string
+		if len(fields) > 2 {
+			decoded, _ := base64.StdEncoding.DecodeString(fields[2])
+			credentials = string(decoded)
+		} else {
+			text.PrintfLine("334 ")
+			credentials = readLine()
+		}
+		s.record(&s.auths, "PLAIN "+strings.ReplaceAll(credentials, "\x00", " "))
+	case "LOGIN":
+		text.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte("Username:")))
+		username := readLine()
+		text.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte("Password:")))
+		password := readLine()
+		s.record(&s.auths, "LOGIN "+username+" "+password)
+	case "CRAM-MD5":
+		challenge := "<1896.697170952@fake.test>"
+		text.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(challenge)))
+		username, digest, _ := strings.Cut(readLine(), " ")
+		mac := hmac.New(md5.New, []byte(s.password))
+		mac.Write([]byte(challenge))
+		if digest != hex.EncodeToString(mac.Sum(nil)) {
+			text.PrintfLine("535 authentication failed")
+			return
+		}
+		s.record(&s.auths, "CRAM-MD5 "+username)
+	default:
+		text.PrintfLine("504 unrecognized authentication type")
+		return
+	}
+	text.PrintfLine("235 2.7.0 authentication successful")
+}
+
+// readData reads a DATA payload up to the terminating dot, undoing dot-stuffing
+// but keeping the CRLF line endings
+func readData(r *bufio.Reader) (string, error) {
+	var data strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		if line == ".\r\n" {
+			return data.String(), nil
+		}
+		data.WriteString(strings.TrimPrefix(line, "."))
+	}
+}
+
+// useConfig sets the package configuration for the duration of the test
+func useConfig(t testing.TB, config EmailConfig) {
+	t.Helper()
+	emailConfig = config
+	t.Cleanup(func() {
+		emailConfig = EmailConfig{}
+		circuit = circuitBreaker{}
+		defaultIdempotencyStore = NewMemoryIdempotencyStore(defaultIdempotencyStoreSize)
+		tlsSessionCache.cache = nil
+	})
+}
+
+// selfSignedTLS returns a server TLS configuration with a self-signed
+// certificate for hosts (names or IP addresses) and a pool trusting it
+func selfSignedTLS(t testing.TB, hosts ...string) (*tls.Config, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}}}, pool
+}
+
+// serverConfig returns a plaintext configuration for sending through s
+func serverConfig(s *fakeServer) EmailConfig {
+	host, port := s.hostPort()
+	return EmailConfig{
+		EmailAddress: "sender@example.com",
+		Password:     "secret",
+		Host:         host,
+		Port:         port,
+		TLSMode:      TLSModeNone,
+	}
+}
+
+// writeAttachment writes data to a file called name in a temporary directory,
+// returning the directory to use as AttachmentPathPrefix and the file path
+func writeAttachment(t testing.TB, name string, data []byte) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return dir, path
+}
+
+// parseMessage parses a composed message
+func parseMessage(t testing.TB, message []byte) *mail.Message {
+	t.Helper()
+	msg, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		t.Fatalf("message doesn't parse: %v\n%s", err, message)
+	}
+	return msg
+}
+
+// composeMessage composes a message with the given options
+func composeMessage(t testing.TB, subject, body, htmlBody, attachmentPath string, to []string, opts ...MessageOption) []byte {
+	t.Helper()
+	message, err := createEmailMessage(subject, body, htmlBody, attachmentPath, to, newMessageOptions(opts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
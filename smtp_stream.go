@@ -0,0 +1,230 @@
+package gosmtpmail
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// messageSource is a message that can be written to the DATA stream
+type messageSource interface {
+	writeTo(w io.Writer) error
+	isASCII() bool
+}
+
+// rawMessage is a fully composed message
+type rawMessage []byte
+
+func (m rawMessage) writeTo(w io.Writer) error {
+	_, err := w.Write(m)
+	return err
+}
+
+func (m rawMessage) isASCII() bool {
+	return isASCII(string(m))
+}
+
+// emailMessage is a composed message whose attachment is read and encoded
+// only while it is written out, so a send that fails before DATA never reads
+// the file. It can be written any number of times.
+type emailMessage struct {
+	// head holds the headers and body parts
+	head bytes.Buffer
+	// boundary is empty for a single-part message
+	boundary string
+	// hasParts is set when head ends with a body part rather than the preamble
+	hasParts         bool
+	attachmentPath   string
+	attachmentSHA256 []byte
+	attachmentInline bool
+	epilogue         string
+}
+
+func (m *emailMessage) writeTo(w io.Writer) error {
+	if emailConfig.EnforceLineLength {
+		w = &lineLengthWriter{w: w, line: 1}
+	}
+	if _, err := w.Write(m.head.Bytes()); err != nil {
+		return err
+	}
+	// A single-part message is complete in head
+	if m.boundary == "" {
+		return nil
+	}
+
+	// Continue the multipart body after the parts in head
+	writer := multipart.NewWriter(w)
+	if err := writer.SetBoundary(m.boundary); err != nil {
+		return err
+	}
+
+	// Attachment part
+	if m.attachmentPath != "" {
+		// The new writer doesn't know about the parts in head, whose last one
+		// must end with the CRLF that precedes the boundary
+		if m.hasParts {
+			if _, err := io.WriteString(w, "\r\n"); err != nil {
+				return err
+			}
+		}
+		if err := writeAttachmentPart(writer, m.attachmentPath, m.attachmentSHA256, m.attachmentInline); err != nil {
+			return err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, m.epilogue)
+	return err
+}
+
+func (m *emailMessage) isASCII() bool {
+	// The attachment is base64-encoded, so only the head can contain 8-bit data
+	return isASCII(m.head.String())
+}
+
+// InlinePolicy decides which attachments are sent with an inline disposition
+type InlinePolicy string
+
+const (
+	// InlineNone sends every attachment as an attachment
+	InlineNone InlinePolicy = ""
+	// InlineImages sends image attachments inline
+	InlineImages InlinePolicy = "images"
+	// InlineReferencedImages sends image attachments inline when the HTML body
+	// references them as cid:<content ID>, see contentID. Inline images are
+	// grouped with the HTML body in multipart/related.
+	InlineReferencedImages InlinePolicy = "referenced-images"
+)
+
+// inlineAttachment reports whether InlinePolicy sends the attachment at path inline
+func inlineAttachment(path, htmlBody string) bool {
+	mediaType, _, _ := mime.ParseMediaType(mime.TypeByExtension(filepath.Ext(path)))
+	if !strings.HasPrefix(mediaType, "image/") {
+		return false
+	}
+	switch emailConfig.InlinePolicy {
+	case InlineImages:
+		return true
+	case InlineReferencedImages:
+		return strings.Contains(htmlBody, "cid:"+contentID(filepath.Base(path)))
+	}
+	return false
+}
+
+// contentID returns the Content-ID of an inline attachment called name. Bytes
+// other than letters, digits, "-", "." and "_" are percent-encoded, keeping the
+// ID valid in the header and matching the cid: URL that references it (RFC 2392).
+func contentID(name string) string {
+	var id strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_' {
+			id.WriteByte(c)
+		} else {
+			fmt.Fprintf(&id, "%%%02X", c)
+		}
+	}
+	return id.String()
+}
+
+// writeAttachmentPart streams the file at path into a base64-encoded part,
+// verifying it against expectedSHA256 when set. Inline parts get a Content-ID
+// derived from the file name so the HTML body can reference them.
+func writeAttachmentPart(writer *multipart.Writer, path string, expectedSHA256 []byte, inline bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	attachmentHeader := textproto.MIMEHeader{}
+	attachmentHeader.Set("Content-Type", mime.TypeByExtension(filepath.Ext(path)))
+	disposition := "attachment"
+	if inline {
+		disposition = "inline"
+		attachmentHeader["Content-ID"] = []string{"<" + contentID(filepath.Base(path)) + ">"}
+	}
+	// FormatMediaType quotes the name and uses RFC 2231 encoding when it isn't ASCII
+	attachmentHeader.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": filepath.Base(path)}))
+	attachmentHeader.Set("Content-Transfer-Encoding", "base64")
+	attachmentPart, err := writer.CreatePart(attachmentHeader)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	encoder := base64.NewEncoder(base64.StdEncoding, &lineWrapWriter{w: attachmentPart, width: base64LineLength})
+	if _, err = io.Copy(encoder, io.TeeReader(file, hash)); err != nil {
+		return err
+	}
+	if err = encoder.Close(); err != nil {
+		return err
+	}
+	if expectedSHA256 != nil && !bytes.Equal(hash.Sum(nil), expectedSHA256) {
+		return ErrAttachmentChecksumMismatch
+	}
+	return nil
+}
+
+// base64LineLength is the maximum length of base64 lines allowed by RFC 2045
+const base64LineLength = 76
+
+// lineWrapWriter breaks the written data into lines of width bytes
+type lineWrapWriter struct {
+	w      io.Writer
+	width  int
+	column int
+}
+
+func (l *lineWrapWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if l.column == l.width {
+			if _, err := io.WriteString(l.w, "\r\n"); err != nil {
+				return written, err
+			}
+			l.column = 0
+		}
+		n, err := l.w.Write(p[:min(len(p), l.width-l.column)])
+		written += n
+		l.column += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// maxLineLength is the SMTP line length limit in octets, including the CRLF
+const maxLineLength = 1000
+
+// lineLengthWriter fails when a line written through it exceeds maxLineLength
+type lineLengthWriter struct {
+	w      io.Writer
+	line   int
+	length int
+}
+
+func (l *lineLengthWriter) Write(p []byte) (int, error) {
+	for _, c := range p {
+		l.length++
+		if l.length > maxLineLength {
+			return 0, fmt.Errorf("line %d is longer than the SMTP limit of %d octets", l.line, maxLineLength)
+		}
+		if c == '\n' {
+			l.line++
+			l.length = 0
+		}
+	}
+	return l.w.Write(p)
+}
@@ -0,0 +1,414 @@
+package gosmtpmail
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAttachmentHeaderEncoding(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+	}{
+		{"quote", `say "hi".txt`},
+		{"non-ASCII", "Grüße.txt"},
+		{"plain", "report.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefix, path := writeAttachment(t, tt.filename, []byte("content"))
+			useConfig(t, EmailConfig{EmailAddress: "sender@example.com", AttachmentPathPrefix: prefix})
+
+			message := string(composeMessage(t, "Attachment", "body", "", path, []string{"jane@example.com"}))
+			if !isASCII(message) {
+				t.Errorf("message with attachment %q isn't ASCII:\n%s", tt.filename, message)
+			}
+			start := strings.Index(message, "Content-Disposition: ")
+			if start < 0 {
+				t.Fatalf("no Content-Disposition:\n%s", message)
+			}
+			line := message[start+len("Content-Disposition: "):]
+			line = line[:strings.Index(line, "\r\n")]
+			disposition, params, err := mime.ParseMediaType(line)
+			if err != nil {
+				t.Fatalf("Content-Disposition %q doesn't parse: %v", line, err)
+			}
+			if disposition != "attachment" || params["filename"] != tt.filename {
+				t.Errorf("Content-Disposition %q = %s, %q; want attachment, %q", line, disposition, params["filename"], tt.filename)
+			}
+		})
+	}
+}
+
+func TestContentID(t *testing.T) {
+	prefix, path := writeAttachment(t, "logo <1>.png", []byte("\x89PNG"))
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com", AttachmentPathPrefix: prefix, InlinePolicy: InlineReferencedImages})
+
+	if got := contentID("logo <1>.png"); got != "logo%20%3C1%3E.png" {
+		t.Errorf("contentID = %q", got)
+	}
+	message := string(composeMessage(t, "Inline", "", `<img src="cid:logo%20%3C1%3E.png">`, path, []string{"jane@example.com"}))
+	if !strings.Contains(message, "Content-ID: <logo%20%3C1%3E.png>") {
+		t.Errorf("inline attachment doesn't have the escaped Content-ID:\n%s", message)
+	}
+}
+
+// partTypes returns the Content-Type of each top-level part of message
+func partTypes(t *testing.T, message []byte) []string {
+	t.Helper()
+	msg := parseMessage(t, message)
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	var types []string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return types
+		}
+		if err != nil {
+			t.Fatalf("message doesn't parse: %v\n%s", err, message)
+		}
+		types = append(types, part.Header.Get("Content-Type"))
+	}
+}
+
+func TestEmailMessageStructure(t *testing.T) {
+	prefix, path := writeAttachment(t, "report.pdf", []byte("%PDF-1.4"))
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com", AttachmentPathPrefix: prefix, AllowAttachmentOnly: true})
+
+	tests := []struct {
+		name, body, htmlBody, attachment string
+		want                             []string
+	}{
+		{"text", "text", "", "", []string{"text/plain; charset=UTF-8"}},
+		{"text and attachment", "text", "", path, []string{"text/plain; charset=UTF-8", "application/pdf"}},
+		{"alternative and attachment", "text", "<p>html</p>", path, []string{"multipart/alternative", "application/pdf"}},
+		{"attachment only", "", "", path, []string{"application/pdf"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			types := partTypes(t, composeMessage(t, "Structure", tt.body, tt.htmlBody, tt.attachment, []string{"jane@example.com"}))
+			if len(types) != len(tt.want) {
+				t.Fatalf("parts = %q, want %q", types, tt.want)
+			}
+			for i := range types {
+				if !strings.HasPrefix(types[i], tt.want[i]) {
+					t.Errorf("part %d = %q, want %q", i, types[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestEmailMessageWriteToIsRepeatable(t *testing.T) {
+	prefix, path := writeAttachment(t, "report.pdf", bytes.Repeat([]byte("data"), 1000))
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com", AttachmentPathPrefix: prefix})
+
+	message, err := composeEmailMessage("Twice", "text", "", path, []string{"jane@example.com"}, messageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var first, second bytes.Buffer
+	if err := message.writeTo(&first); err != nil {
+		t.Fatal(err)
+	}
+	if err := message.writeTo(&second); err != nil {
+		t.Fatal(err)
+	}
+	if first.String() != second.String() {
+		t.Errorf("second write differs from the first:\n%s\n---\n%s", first.String(), second.String())
+	}
+	partTypes(t, second.Bytes())
+}
+
+func TestStreamedMessageSentTwiceByMiddleware(t *testing.T) {
+	server := newFakeServer(t)
+	prefix, path := writeAttachment(t, "report.pdf", bytes.Repeat([]byte("data"), 1000))
+	config := serverConfig(server)
+	config.AttachmentPathPrefix = prefix
+	config.StreamAttachments = true
+	config.Middleware = []SendMiddleware{func(next SendFunc) SendFunc {
+		return func(from string, to []string, msg []byte) error {
+			if err := next(from, to, msg); err != nil {
+				return err
+			}
+			return next(from, to, msg)
+		}
+	}}
+	useConfig(t, config)
+
+	if err := Send("Twice", "text", "", path, []string{"jane@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	messages := server.Messages()
+	if len(messages) != 2 {
+		t.Fatalf("got %d messages, want 2", len(messages))
+	}
+	if messages[0] != messages[1] {
+		t.Errorf("second send differs from the first:\n%s\n---\n%s", messages[0], messages[1])
+	}
+	if types := partTypes(t, []byte(messages[1])); len(types) != 2 {
+		t.Errorf("second message has parts %q, want text and attachment", types)
+	}
+}
+
+func TestStreamedAttachmentNotReadOnConnectFailure(t *testing.T) {
+	// A listener that is closed right away refuses connections
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+
+	prefix, path := writeAttachment(t, "report.pdf", []byte("%PDF-1.4"))
+	useConfig(t, EmailConfig{
+		EmailAddress: "sender@example.com", Host: host, Port: port, TLSMode: TLSModeNone,
+		AttachmentPathPrefix: prefix, StreamAttachments: true,
+	})
+
+	// The checksum doesn't match, so reading the attachment would fail with ErrAttachmentChecksumMismatch
+	err = Send("Refused", "text", "", path, []string{"jane@example.com"}, WithAttachmentSHA256(strings.Repeat("00", 32)))
+	var smtpErr *SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Phase != PhaseConnect {
+		t.Fatalf("send to a refused port returned %v, want a connect error", err)
+	}
+	if errors.Is(err, ErrAttachmentChecksumMismatch) {
+		t.Error("attachment was read before connecting")
+	}
+}
+
+func TestStreamThreshold(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold int64
+		size      int
+		streamed  bool
+	}{
+		{"below the default", 0, 1 << 20, false},
+		{"above the default", 0, defaultStreamThresholdBytes + 1, true},
+		{"disabled", -1, defaultStreamThresholdBytes + 1, false},
+		{"below threshold", 1024, 1000, false},
+		{"at threshold", 1024, 1024, false},
+		{"above threshold", 1024, 2000, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeServer(t)
+			prefix, path := writeAttachment(t, "report.pdf", bytes.Repeat([]byte("x"), tt.size))
+			config := serverConfig(server)
+			config.AttachmentPathPrefix = prefix
+			config.StreamThresholdBytes = tt.threshold
+			var gotNil bool
+			config.Middleware = []SendMiddleware{func(next SendFunc) SendFunc {
+				return func(from string, to []string, msg []byte) error {
+					gotNil = msg == nil
+					return next(from, to, msg)
+				}
+			}}
+			useConfig(t, config)
+
+			if err := Send("Threshold", "text", "", path, []string{"jane@example.com"}); err != nil {
+				t.Fatal(err)
+			}
+			if gotNil != tt.streamed {
+				t.Errorf("middleware got nil msg = %v, want %v", gotNil, tt.streamed)
+			}
+			if messages := server.Messages(); len(messages) != 1 || len(partTypes(t, []byte(messages[0]))) != 2 {
+				t.Errorf("message not delivered with its attachment: %q", messages)
+			}
+		})
+	}
+}
+
+func TestAttachmentSHA256(t *testing.T) {
+	data := []byte("%PDF-1.4 signed release")
+	sum := sha256.Sum256(data)
+	checksum := hex.EncodeToString(sum[:])
+	other := sha256.Sum256([]byte("tampered"))
+
+	for _, stream := range []bool{false, true} {
+		server := newFakeServer(t)
+		prefix, path := writeAttachment(t, "release.pdf", data)
+		config := serverConfig(server)
+		config.AttachmentPathPrefix = prefix
+		config.StreamAttachments = stream
+		useConfig(t, config)
+
+		if err := Send("Match", "text", "", path, []string{"jane@example.com"}, WithAttachmentSHA256(checksum)); err != nil {
+			t.Errorf("stream=%v: matching checksum: %v", stream, err)
+		}
+		err := Send("Mismatch", "text", "", path, []string{"jane@example.com"}, WithAttachmentSHA256(hex.EncodeToString(other[:])))
+		if !errors.Is(err, ErrAttachmentChecksumMismatch) {
+			t.Errorf("stream=%v: mismatching checksum returned %v, want ErrAttachmentChecksumMismatch", stream, err)
+		}
+		if messages := server.Messages(); len(messages) != 1 {
+			t.Errorf("stream=%v: server received %d messages, want only the matching one", stream, len(messages))
+		}
+	}
+
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com"})
+	for _, invalid := range []string{"not hex", checksum[:10]} {
+		if _, err := createEmailMessage("Invalid", "text", "", "", []string{"jane@example.com"}, newMessageOptions([]MessageOption{WithAttachmentSHA256(invalid)})); err == nil {
+			t.Errorf("invalid checksum %q accepted", invalid)
+		}
+	}
+}
+
+func TestLineWrapWriter(t *testing.T) {
+	// Two 120-character lines' worth of base64, written in uneven pieces
+	encoded := strings.Repeat("QUJD", 60)
+	var out bytes.Buffer
+	writer := &lineWrapWriter{w: &out, width: base64LineLength}
+	for _, piece := range []string{encoded[:7], encoded[7:120], encoded[120:]} {
+		if _, err := io.WriteString(writer, piece); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines := strings.Split(out.String(), "\r\n")
+	for i, line := range lines[:len(lines)-1] {
+		if len(line) != base64LineLength {
+			t.Errorf("line %d has %d characters, want %d", i, len(line), base64LineLength)
+		}
+	}
+	if strings.Join(lines, "") != encoded || len(lines[len(lines)-1]) != len(encoded)%base64LineLength {
+		t.Errorf("wrapped output doesn't rejoin to the input: %q", out.String())
+	}
+}
+
+func TestAttachmentBase64Wrapped(t *testing.T) {
+	// 90 bytes encode to a single 120-character base64 line
+	data := bytes.Repeat([]byte("abc"), 30)
+	prefix, path := writeAttachment(t, "data.bin", data)
+	useConfig(t, EmailConfig{EmailAddress: "sender@example.com", AttachmentPathPrefix: prefix})
+
+	message := string(composeMessage(t, "Wrapped", "text", "", path, []string{"jane@example.com"}))
+	encoded := base64.StdEncoding.EncodeToString(data)
+	if want := encoded[:76] + "\r\n" + encoded[76:] + "\r\n"; !strings.Contains(message, want) {
+		t.Errorf("attachment not wrapped at 76 columns:\n%s", message)
+	}
+}
+
+// attachmentDisposition returns the disposition type of the file part of message
+func attachmentDisposition(t *testing.T, message []byte) string {
+	t.Helper()
+	msg := parseMessage(t, message)
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatalf("no attachment part: %v\n%s", err, message)
+		}
+		if disposition, _, err := mime.ParseMediaType(part.Header.Get("Content-Disposition")); err == nil {
+			return disposition
+		}
+	}
+}
+
+func TestInlinePolicy(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	png, pdf := writeFile("logo.png"), writeFile("report.pdf")
+	referencing := `<img src="cid:logo.png"><a href="cid:report.pdf">report</a>`
+
+	tests := []struct {
+		policy   InlinePolicy
+		html     string
+		png, pdf string
+	}{
+		{InlineNone, referencing, "attachment", "attachment"},
+		{InlineImages, "<p>html</p>", "inline", "attachment"},
+		{InlineReferencedImages, referencing, "inline", "attachment"},
+		{InlineReferencedImages, "<p>html</p>", "attachment", "attachment"},
+	}
+	for _, tt := range tests {
+		useConfig(t, EmailConfig{EmailAddress: "sender@example.com", AttachmentPathPrefix: dir, InlinePolicy: tt.policy})
+		for path, want := range map[string]string{png: tt.png, pdf: tt.pdf} {
+			message := composeMessage(t, "Inline", "text", tt.html, path, []string{"jane@example.com"})
+			if got := attachmentDisposition(t, message); got != want {
+				t.Errorf("policy %q, HTML %q: %s has disposition %q, want %q", tt.policy, tt.html, filepath.Base(path), got, want)
+			}
+		}
+	}
+}
+
+func TestInlineImagesInMultipartRelated(t *testing.T) {
+	prefix, path := writeAttachment(t, "logo.png", []byte("\x89PNG"))
+	pdf := filepath.Join(prefix, "report.pdf")
+	if err := os.WriteFile(pdf, []byte("%PDF-1.4"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	html := `<p>Hi</p><img src="cid:logo.png">`
+
+	tests := []struct {
+		name, body, html, path string
+		rootType, relatedType  string
+		parts                  []string
+	}{
+		{"text and HTML", "text", html, path, "multipart/related", "multipart/alternative", []string{"multipart/alternative", "image/png"}},
+		{"HTML only", "", html, path, "multipart/related", "text/html", []string{"text/html; charset=UTF-8", "image/png"}},
+		{"not inline", "text", html, pdf, "multipart/mixed", "", []string{"multipart/alternative", "application/pdf"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, EmailConfig{EmailAddress: "sender@example.com", AttachmentPathPrefix: prefix, InlinePolicy: InlineReferencedImages})
+			message := composeMessage(t, "Related", tt.body, tt.html, tt.path, []string{"jane@example.com"})
+
+			msg := parseMessage(t, message)
+			rootType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rootType != tt.rootType || params["type"] != tt.relatedType {
+				t.Errorf("root Content-Type = %q, want %s with type %q", msg.Header.Get("Content-Type"), tt.rootType, tt.relatedType)
+			}
+			reader := multipart.NewReader(msg.Body, params["boundary"])
+			var parts []string
+			for {
+				part, err := reader.NextPart()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+				if strings.HasPrefix(mediaType, "text/") {
+					mediaType = part.Header.Get("Content-Type")
+				}
+				parts = append(parts, mediaType)
+				if mediaType == "image/png" && part.Header.Get("Content-Id") != "<logo.png>" {
+					t.Errorf("inline image Content-ID = %q, want <logo.png>", part.Header.Get("Content-Id"))
+				}
+			}
+			if fmt.Sprint(parts) != fmt.Sprint(tt.parts) {
+				t.Errorf("parts = %q, want %q", parts, tt.parts)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package gosmtpmail
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// defaultWrapWidth is the line width recommended by RFC 5322
+const defaultWrapWidth = 78
+
+// wrapText soft-wraps text at width columns, breaking only at whitespace and
+// keeping existing line breaks and the original spacing. Words longer than
+// width (e.g. URLs) are never split.
+func wrapText(text string, width int) string {
+	if width <= 0 {
+		width = defaultWrapWidth
+	}
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if utf8.RuneCountInString(strings.TrimSuffix(line, "\r")) <= width {
+			continue
+		}
+
+		// Keep the line ending style of the original line
+		lineBreak := "\n"
+		if strings.HasSuffix(line, "\r") {
+			lineBreak = "\r\n"
+			line = strings.TrimSuffix(line, "\r")
+		}
+
+		var wrapped strings.Builder
+		lineLength := 0
+		for line != "" {
+			// Each token is a run of whitespace followed by a word
+			wordStart := strings.IndexFunc(line, func(r rune) bool { return r != ' ' && r != '\t' })
+			if wordStart < 0 {
+				// Trailing whitespace stays on the last line
+				wrapped.WriteString(line)
+				break
+			}
+			wordEnd := strings.IndexAny(line[wordStart:], " \t")
+			if wordEnd < 0 {
+				wordEnd = len(line)
+			} else {
+				wordEnd += wordStart
+			}
+			space, word := line[:wordStart], line[wordStart:wordEnd]
+			line = line[wordEnd:]
+
+			spaceLength := utf8.RuneCountInString(space)
+			wordLength := utf8.RuneCountInString(word)
+			if lineLength > 0 && lineLength+spaceLength+wordLength > width {
+				// The whitespace at a break is replaced by the line break
+				wrapped.WriteString(lineBreak)
+				lineLength = 0
+				space, spaceLength = "", 0
+			}
+			wrapped.WriteString(space)
+			wrapped.WriteString(word)
+			lineLength += spaceLength + wordLength
+		}
+		if lineBreak == "\r\n" {
+			wrapped.WriteByte('\r')
+		}
+		lines[i] = wrapped.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// flowedWidth is the line width RFC 3676 recommends for format=flowed
+const flowedWidth = 72
+
+// flowText formats text as RFC 3676 format=flowed: long lines are soft-wrapped
+// with a trailing space, hard line breaks lose trailing spaces (except in the
+// "-- " signature separator) and lines starting with a space, ">" or "From "
+// are space-stuffed.
+func flowText(text string) string {
+	var flowed []string
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		// The signature separator keeps its trailing space (RFC 3676 section 4.3)
+		if line == "-- " {
+			flowed = append(flowed, line)
+			continue
+		}
+		line = strings.TrimRight(line, " ")
+		words := strings.Split(line, " ")
+
+		// Soft-wrap, keeping a trailing space on every line but the last
+		var current strings.Builder
+		for i, word := range words {
+			if current.Len() > 0 && utf8.RuneCountInString(current.String())+utf8.RuneCountInString(word) > flowedWidth {
+				flowed = append(flowed, spaceStuff(current.String()))
+				current.Reset()
+			}
+			current.WriteString(word)
+			if i < len(words)-1 {
+				current.WriteByte(' ')
+			}
+		}
+		flowed = append(flowed, spaceStuff(current.String()))
+	}
+	return strings.Join(flowed, "\r\n")
+}
+
+// spaceStuff prefixes a line with a space when it could otherwise be misread
+// as quoted text or a stuffed line
+func spaceStuff(line string) string {
+	if strings.HasPrefix(line, " ") || strings.HasPrefix(line, ">") || strings.HasPrefix(line, "From ") {
+		return " " + line
+	}
+	return line
+}
+
+// normalizeLineEndings converts bare LF and bare CR line endings to CRLF
+func normalizeLineEndings(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	return strings.ReplaceAll(text, "\n", "\r\n")
+}
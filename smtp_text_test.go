@@ -0,0 +1,92 @@
+package gosmtpmail
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestWrapTextKeepsSpacing(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		width int
+		want  string
+	}{
+		{"short line untouched", "a  b\tc", 10, "a  b\tc"},
+		{"breaks at whitespace", "aaaa bbbb cccc", 9, "aaaa bbbb\ncccc"},
+		{"keeps internal spacing", "aa  bb\tcc dddddd", 9, "aa  bb\tcc\ndddddd"},
+		{"keeps indentation", "    indented words here", 12, "    indented\nwords here"},
+		{"keeps trailing whitespace", "aaaa bbbb cccc  ", 9, "aaaa bbbb\ncccc  "},
+		{"long word not split", "short https://example.com/a/very/long/url end", 10, "short\nhttps://example.com/a/very/long/url\nend"},
+		{"keeps CRLF", "aaaa bbbb cccc\r\nnext", 9, "aaaa bbbb\r\ncccc\r\nnext"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := wrapText(tt.text, tt.width); got != tt.want {
+				t.Errorf("wrapText(%q, %d) = %q, want %q", tt.text, tt.width, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWrapTextWidth(t *testing.T) {
+	text := strings.Repeat("lorem ipsum  dolor\tsit amet ", 20) + "https://example.com/" + strings.Repeat("x", 100)
+	for _, line := range strings.Split(wrapText(text, 30), "\n") {
+		if utf8.RuneCountInString(line) > 30 && strings.ContainsAny(strings.TrimSpace(line), " \t") {
+			t.Errorf("line longer than 30 columns has a break opportunity: %q", line)
+		}
+	}
+}
+
+func TestWrapPlainTextOnTheWire(t *testing.T) {
+	server := newFakeServer(t)
+	config := serverConfig(server)
+	config.WrapPlainText = true
+	config.PlainTextWrapWidth = 20
+	useConfig(t, config)
+
+	if err := Send("Wrapped", "first  second\tthird fourth fifth", "", "", []string{"jane@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	messages := server.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("got %d messages, want 1", len(messages))
+	}
+	if !strings.Contains(messages[0], "first  second\tthird\r\nfourth fifth") {
+		t.Errorf("body not wrapped with original spacing:\n%s", messages[0])
+	}
+}
+
+func TestFlowText(t *testing.T) {
+	long := strings.Repeat("word ", 20) + "end"
+	flowed := flowText("> quoted\n leading space\nFrom here\ntrailing   \n" + long + "\n-- \nJane")
+	lines := strings.Split(flowed, "\r\n")
+
+	for i, want := range []string{" > quoted", "  leading space", " From here", "trailing"} {
+		if lines[i] != want {
+			t.Errorf("line %d = %q, want %q", i, lines[i], want)
+		}
+	}
+
+	// The long line is soft-wrapped with trailing spaces, the last piece ends hard
+	wrapped := lines[4 : len(lines)-2]
+	if len(wrapped) < 2 {
+		t.Fatalf("long line not wrapped: %q", wrapped)
+	}
+	for i, line := range wrapped {
+		if utf8.RuneCountInString(line) > flowedWidth+1 {
+			t.Errorf("flowed line %q is longer than %d columns", line, flowedWidth)
+		}
+		if soft := strings.HasSuffix(line, " "); soft != (i < len(wrapped)-1) {
+			t.Errorf("flowed line %d %q: trailing space %v", i, line, soft)
+		}
+	}
+	if strings.Join(wrapped, "") != long {
+		t.Errorf("wrapped lines don't rejoin to the original: %q", wrapped)
+	}
+
+	if lines[len(lines)-2] != "-- " || lines[len(lines)-1] != "Jane" {
+		t.Errorf("signature separator changed: %q", lines[len(lines)-2:])
+	}
+}